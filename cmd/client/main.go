@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"strings"
 
+	srv "github.com/jacobmichels/tail-sts/pkg/server"
 	"github.com/urfave/cli/v2"
 )
 
@@ -52,10 +54,6 @@ func main() {
 	}
 }
 
-type Response struct {
-	AccessToken string `json:"token"`
-}
-
 func run(c *cli.Context, logger *slog.Logger) error {
 	logger.Info("Running TailSTS Client")
 
@@ -63,15 +61,19 @@ func run(c *cli.Context, logger *slog.Logger) error {
 	token := c.String("token")
 	scopes := c.String("scopes")
 
-	body := `{"scopes": ["` + scopes + `"]}`
+	body, err := json.Marshal(srv.Request{Scopes: strings.Split(scopes, ",")})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
 
-	req, err := http.NewRequest("POST", server, strings.NewReader(body))
+	req, err := http.NewRequest("POST", server, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
 
 	client := http.Client{}
 	resp, err := client.Do(req)
@@ -81,18 +83,24 @@ func run(c *cli.Context, logger *slog.Logger) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed: %s", resp.Status)
+		var reqErr srv.Error
+		err = json.NewDecoder(resp.Body).Decode(&reqErr)
+		if err != nil {
+			return fmt.Errorf("request failed: %s", resp.Status)
+		}
+
+		return fmt.Errorf("request failed: %s: %w", resp.Status, &reqErr)
 	}
 
 	logger.Info("Request successful", "status", resp.Status)
 
-	accessToken := Response{}
+	accessToken := srv.Response{}
 	err = json.NewDecoder(resp.Body).Decode(&accessToken)
 	if err != nil {
 		return fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	logger.Info("Response", "accessToken", accessToken.AccessToken)
+	logger.Info("Response", "accessToken", accessToken.AccessToken, "expiresIn", accessToken.ExpiresIn, "scope", accessToken.Scope, "policy", accessToken.Policy)
 
 	return nil
 }
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/jacobmichels/tail-sts/pkg/config"
 	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/jacobmichels/tail-sts/pkg/replay"
 	"github.com/jacobmichels/tail-sts/pkg/server"
 	"github.com/urfave/cli/v2"
 )
@@ -31,12 +38,114 @@ func main() {
 				EnvVars: []string{"TS_TOKEN_URL"},
 				Value:   "https://api.tailscale.com/api/v2/oauth/token",
 			},
+			&cli.StringSliceFlag{
+				Name:    "ts-client-scopes",
+				Usage:   "Scopes the Tailscale client was created with. Tokens with other scopes are refused without asking Tailscale. Not checked if empty",
+				EnvVars: []string{"TS_CLIENT_SCOPES"},
+			},
+			&cli.IntFlag{
+				Name:    "ts-retry-attempts",
+				Usage:   "How many times a Tailscale access token is requested before giving up, on server errors, network errors and rate limiting. 1 disables retries",
+				EnvVars: []string{"TS_RETRY_ATTEMPTS"},
+				Value:   server.DefaultResilienceConfig().MaxAttempts,
+			},
+			&cli.DurationFlag{
+				Name:    "ts-retry-backoff",
+				Usage:   "Delay before the first retry of a Tailscale access token request, doubled on every further retry and jittered",
+				EnvVars: []string{"TS_RETRY_BACKOFF"},
+				Value:   server.DefaultResilienceConfig().BaseBackoff,
+			},
+			&cli.DurationFlag{
+				Name:    "ts-retry-max-backoff",
+				Usage:   "Longest delay between retries of a Tailscale access token request",
+				EnvVars: []string{"TS_RETRY_MAX_BACKOFF"},
+				Value:   server.DefaultResilienceConfig().MaxBackoff,
+			},
+			&cli.DurationFlag{
+				Name:    "ts-retry-max-retry-after",
+				Usage:   "Longest Retry-After of a rate limited Tailscale access token request that is waited for. Requests asked to wait longer fail",
+				EnvVars: []string{"TS_RETRY_MAX_RETRY_AFTER"},
+				Value:   server.DefaultResilienceConfig().MaxRetryAfter,
+			},
+			&cli.IntFlag{
+				Name:    "ts-circuit-failure-threshold",
+				Usage:   "How many Tailscale access token requests in a row must fail, after their retries, for requests to fail fast with 503 until the cooldown ends. 0 disables the circuit breaker",
+				EnvVars: []string{"TS_CIRCUIT_FAILURE_THRESHOLD"},
+				Value:   server.DefaultResilienceConfig().FailureThreshold,
+			},
+			&cli.DurationFlag{
+				Name:    "ts-circuit-cooldown",
+				Usage:   "How long requests fail fast once the circuit breaker opens, before Tailscale is tried again",
+				EnvVars: []string{"TS_CIRCUIT_COOLDOWN"},
+				Value:   server.DefaultResilienceConfig().Cooldown,
+			},
+			&cli.StringFlag{
+				Name:    "ts-api-url",
+				Usage:   "Tailscale API URL, used to create auth keys",
+				EnvVars: []string{"TS_API_URL"},
+				Value:   server.DefaultTailscaleAPIURL,
+			},
+			&cli.StringFlag{
+				Name:    "ts-tailnet",
+				Usage:   "Tailnet to create auth keys in. \"-\" is the tailnet of the OAuth client",
+				EnvVars: []string{"TS_TAILNET"},
+				Value:   server.DefaultTailnet,
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Config file defining the Tailscale OAuth clients of the default backend, and named backends that policies can use with their backend field",
+				EnvVars: []string{"CONFIG_FILE"},
+			},
 			&cli.StringFlag{
 				Name:    "policies-dir",
 				Usage:   "Directory containing policy files",
 				EnvVars: []string{"POLICIES_DIR"},
 				Value:   "policies",
 			},
+			&cli.StringSliceFlag{
+				Name:    "policies-include",
+				Usage:   "Globs of policy files to load, relative to the policies directory. Globs without a '/' match file names",
+				EnvVars: []string{"POLICIES_INCLUDE"},
+				Value:   cli.NewStringSlice("*.toml"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "policies-exclude",
+				Usage:   "Globs of policy files to skip, relative to the policies directory. Globs without a '/' match file names",
+				EnvVars: []string{"POLICIES_EXCLUDE"},
+			},
+			&cli.BoolFlag{
+				Name:    "watch-policies",
+				Usage:   "Reload policies when the policies directory changes. Policies are always reloaded on SIGHUP",
+				EnvVars: []string{"WATCH_POLICIES"},
+				Value:   true,
+			},
+			&cli.StringFlag{
+				Name:    "jwks-cache-dir",
+				Usage:   "Directory to keep a snapshot of every policy's JWKS in, used after a restart until the JWKS is fetched. Snapshots are not kept if empty",
+				EnvVars: []string{"JWKS_CACHE_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    "jwks-cache-max-staleness",
+				Usage:   "How old a JWKS snapshot may be and still be used",
+				EnvVars: []string{"JWKS_CACHE_MAX_STALENESS"},
+				Value:   24 * time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "replay-store-path",
+				Usage:   "File to remember the tokens accepted by single-use policies in, so they stay used across restarts. They are kept in memory if empty",
+				EnvVars: []string{"REPLAY_STORE_PATH"},
+			},
+			&cli.IntFlag{
+				Name:    "replay-cache-size",
+				Usage:   "How many tokens accepted by single-use policies are remembered in memory",
+				EnvVars: []string{"REPLAY_CACHE_SIZE"},
+				Value:   replay.DefaultCapacity,
+			},
+			&cli.BoolFlag{
+				Name:    "opaque-errors",
+				Usage:   "Answer every authorization failure with the same error and a request ID, so callers cannot learn which issuers, subjects and scopes are trusted. The reason is logged with the request ID",
+				EnvVars: []string{"OPAQUE_ERRORS"},
+			},
 			&cli.BoolFlag{
 				Name:    "json-logging",
 				Usage:   "Enable JSON logging",
@@ -74,28 +183,179 @@ func run(c *cli.Context, logger *slog.Logger) error {
 	ctx := c.Context
 	logger.Info("TailSTS warming up")
 
-	logger.Debug("Loading policies")
-	policies, err := policy.GetPolicies(ctx, c.String("policies-dir"))
+	cfg, err := loadConfig(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	resilience := server.ResilienceConfig{
+		MaxAttempts:      c.Int("ts-retry-attempts"),
+		BaseBackoff:      c.Duration("ts-retry-backoff"),
+		MaxBackoff:       c.Duration("ts-retry-max-backoff"),
+		MaxRetryAfter:    c.Duration("ts-retry-max-retry-after"),
+		FailureThreshold: c.Int("ts-circuit-failure-threshold"),
+		Cooldown:         c.Duration("ts-circuit-cooldown"),
+	}
+
+	backends, err := newBackends(cfg, resilience)
 	if err != nil {
-		return fmt.Errorf("failed to get policies: %w", err)
+		return err
 	}
-	logger.Debug("Policies loaded", "count", len(policies))
 
-	err = policy.ValidatePolicies(policies)
+	tsClient, err := newDefaultFetcher(c, cfg, resilience)
 	if err != nil {
-		return fmt.Errorf("failed to validate policies: %w", err)
+		return err
+	}
+
+	logger.Debug("Loading policies")
+
+	readOpts := policy.ReadOptions{
+		Include: c.StringSlice("policies-include"),
+		Exclude: c.StringSlice("policies-exclude"),
+	}
+	var cache *policy.JwksCache
+	if dir := c.String("jwks-cache-dir"); dir != "" {
+		cache = policy.NewJwksCache(dir, c.Duration("jwks-cache-max-staleness"))
 	}
 
-	tsClient := server.NewOAuthFetcher(c.String("ts-client-id"), c.String("ts-client-secret"), c.String("ts-token-url"))
+	reloader := policy.NewReloader(logger, c.String("policies-dir"), readOpts, cfg.BackendNames(), cache)
+	err = reloader.Reload(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("watch-policies") {
+		err = reloader.Watch(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Debug("Watching policies directory for changes")
+	}
+
+	go reloadOnSIGHUP(ctx, logger, reloader)
+
 	verif := server.JWKSVerifier{}
 
 	logger.Debug("Dependencies initialized, preparing server")
 	port := c.Int("port")
 
-	handler := server.NewTokenRequestHandler(logger, policies, tsClient, verif)
+	var replayStore replay.Store
+	if path := c.String("replay-store-path"); path != "" {
+		fileStore, err := replay.NewFileStore(path)
+		if err != nil {
+			return err
+		}
+		defer fileStore.Close()
+		replayStore = fileStore
+	} else {
+		replayStore = replay.NewMemoryStore(c.Int("replay-cache-size"))
+	}
+
+	handlerOpts := []server.HandlerOption{
+		server.WithReplayStore(replayStore),
+		server.WithAuthKeyCreator(server.NewTailscaleKeyCreator(c.String("ts-api-url"), c.String("ts-tailnet"))),
+		server.WithBackends(backends),
+	}
+	if c.Bool("opaque-errors") {
+		handlerOpts = append(handlerOpts, server.WithOpaqueErrors())
+	}
+
+	handler := server.NewTokenRequestHandler(logger, reloader.Store(), tsClient, verif, handlerOpts...)
 	server.Start(ctx, logger, handler, port)
 
 	logger.Info("Server shutdown")
 
 	return nil
 }
+
+// loadConfig reads the config file, returning an empty config if there is none
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return &config.Config{}, nil
+	}
+
+	return config.Load(path)
+}
+
+// newBackends builds a fetcher and an auth key creator for every backend in the config
+func newBackends(cfg *config.Config, resilience server.ResilienceConfig) (map[string]server.Backend, error) {
+	backends := make(map[string]server.Backend, len(cfg.Backends))
+	for name, backend := range cfg.Backends {
+		fetcher, err := newFetcher(backend.OAuthClients(), resilience)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+
+		backends[name] = server.Backend{
+			Fetcher: fetcher,
+			Keys:    server.NewTailscaleKeyCreator(backend.APIURL, backend.Tailnet),
+		}
+	}
+
+	return backends, nil
+}
+
+// newDefaultFetcher builds the fetcher of the default backend, from the clients in the config or else from the flags
+func newDefaultFetcher(c *cli.Context, cfg *config.Config, resilience server.ResilienceConfig) (server.AccessTokenFetcher, error) {
+	if len(cfg.Clients) == 0 {
+		return newFetcher([]config.Client{{
+			Name:         c.String("ts-client-id"),
+			ClientID:     c.String("ts-client-id"),
+			ClientSecret: c.String("ts-client-secret"),
+			TokenURL:     c.String("ts-token-url"),
+			Scopes:       c.StringSlice("ts-client-scopes"),
+		}}, resilience)
+	}
+
+	if c.IsSet("ts-client-id") || c.IsSet("ts-client-secret") {
+		return nil, errors.New("the Tailscale client flags cannot be combined with clients in the config file")
+	}
+
+	fetcher, err := newFetcher(cfg.Clients, resilience)
+	if err != nil {
+		return nil, fmt.Errorf("clients: %w", err)
+	}
+
+	return fetcher, nil
+}
+
+// newFetcher builds a fetcher for the clients. Tokens are fetched from the least-privileged client that can grant them,
+// unless there is a single client without declared scopes, which is trusted to grant every scope.
+// Every client retries failed requests and has its own circuit breaker.
+func newFetcher(clients []config.Client, resilience server.ResilienceConfig) (server.AccessTokenFetcher, error) {
+	scoped := make([]server.ScopedClient, 0, len(clients))
+	for _, client := range clients {
+		secret, err := client.Secret()
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %w", client.Name, err)
+		}
+
+		fetcher := server.NewOAuthFetcher(client.ClientID, secret, client.TokenURL, server.WithResilience(resilience))
+		if len(clients) == 1 && len(client.Scopes) == 0 {
+			return fetcher, nil
+		}
+
+		scoped = append(scoped, server.ScopedClient{Name: client.Name, Scopes: client.Scopes, Fetcher: fetcher})
+	}
+
+	return server.NewSelectingFetcher(scoped)
+}
+
+func reloadOnSIGHUP(ctx context.Context, logger *slog.Logger, reloader *policy.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP received, reloading policies")
+			err := reloader.Reload(ctx)
+			if err != nil {
+				logger.Error("Failed to reload policies, keeping the previous policies", "error", err)
+			}
+		}
+	}
+}
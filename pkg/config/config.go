@@ -0,0 +1,225 @@
+// Package config reads the server's config file, which defines the Tailscale credentials policies can reference.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	DefaultTokenURL = "https://api.tailscale.com/api/v2/oauth/token"
+	DefaultAPIURL   = "https://api.tailscale.com"
+	// The tailnet of the OAuth client
+	DefaultTailnet = "-"
+)
+
+type Config struct {
+	// OAuth clients of the default backend, used instead of the client set by flags
+	Clients []Client `toml:"clients"`
+	// Tailscale OAuth clients by name, referenced by the backend field of policies
+	Backends map[string]Backend `toml:"backends"`
+}
+
+// A Tailscale OAuth client.
+// The client secret is read from exactly one of client_secret, client_secret_env and client_secret_file.
+type Client struct {
+	// identifies the client in logs and errors. Defaults to the client ID
+	Name             string `toml:"name"`
+	ClientID         string `toml:"client_id"`
+	ClientSecret     string `toml:"client_secret"`
+	ClientSecretEnv  string `toml:"client_secret_env"`
+	ClientSecretFile string `toml:"client_secret_file"`
+	TokenURL         string `toml:"token_url"`
+	// the scopes the client was created with. Required when there are several clients to choose from
+	Scopes []string `toml:"scopes"`
+}
+
+// The Tailscale OAuth clients of a tailnet, and the tailnet itself.
+// A backend has either a single client, set by its own client fields, or several listed in clients.
+type Backend struct {
+	ClientID         string   `toml:"client_id"`
+	ClientSecret     string   `toml:"client_secret"`
+	ClientSecretEnv  string   `toml:"client_secret_env"`
+	ClientSecretFile string   `toml:"client_secret_file"`
+	TokenURL         string   `toml:"token_url"`
+	Scopes           []string `toml:"scopes"`
+	Clients          []Client `toml:"clients"`
+	APIURL           string   `toml:"api_url"`
+	Tailnet          string   `toml:"tailnet"`
+}
+
+// Load reads and validates the config file at path, filling in defaults
+func Load(path string) (*Config, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var cfg Config
+	err = toml.NewDecoder(bytes.NewReader(contents)).DisallowUnknownFields().Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	cfg.Clients = withDefaults(cfg.Clients)
+	for name, backend := range cfg.Backends {
+		if len(backend.Clients) == 0 && backend.TokenURL == "" {
+			backend.TokenURL = DefaultTokenURL
+		}
+		backend.Clients = withDefaults(backend.Clients)
+		if backend.APIURL == "" {
+			backend.APIURL = DefaultAPIURL
+		}
+		if backend.Tailnet == "" {
+			backend.Tailnet = DefaultTailnet
+		}
+		cfg.Backends[name] = backend
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// BackendNames returns the names of the backends, sorted
+func (c *Config) BackendNames() []string {
+	return slices.Sorted(maps.Keys(c.Backends))
+}
+
+// OAuthClients returns the clients of the backend, either its own client or the ones listed in clients
+func (b Backend) OAuthClients() []Client {
+	if len(b.Clients) > 0 {
+		return b.Clients
+	}
+
+	return []Client{{
+		Name:             b.ClientID,
+		ClientID:         b.ClientID,
+		ClientSecret:     b.ClientSecret,
+		ClientSecretEnv:  b.ClientSecretEnv,
+		ClientSecretFile: b.ClientSecretFile,
+		TokenURL:         b.TokenURL,
+		Scopes:           b.Scopes,
+	}}
+}
+
+func (b Backend) hasInlineClient() bool {
+	return b.ClientID != "" || b.ClientSecret != "" || b.ClientSecretEnv != "" || b.ClientSecretFile != "" || b.TokenURL != "" || len(b.Scopes) > 0
+}
+
+func withDefaults(clients []Client) []Client {
+	for i := range clients {
+		if clients[i].Name == "" {
+			clients[i].Name = clients[i].ClientID
+		}
+		if clients[i].TokenURL == "" {
+			clients[i].TokenURL = DefaultTokenURL
+		}
+	}
+
+	return clients
+}
+
+func (c *Config) validate() error {
+	result := validateClients(c.Clients)
+	if result != nil {
+		result = fmt.Errorf("clients: %w", result)
+	}
+
+	for _, name := range c.BackendNames() {
+		if strings.TrimSpace(name) == "" {
+			result = errors.Join(result, errors.New("empty backend name"))
+			continue
+		}
+
+		backend := c.Backends[name]
+		var err error
+		if len(backend.Clients) > 0 && backend.hasInlineClient() {
+			err = errors.New("client_id, client_secret, client_secret_env, client_secret_file, token_url and scopes cannot be combined with clients")
+		} else {
+			err = validateClients(backend.OAuthClients())
+		}
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("backend %s: %w", name, err))
+		}
+	}
+
+	return result
+}
+
+func validateClients(clients []Client) error {
+	var result error
+	for i, client := range clients {
+		err := client.validate()
+		// the client to fetch a token from is chosen by the scopes it can grant
+		if len(clients) > 1 && len(client.Scopes) == 0 {
+			err = errors.Join(err, errors.New("missing scopes, required when there are several clients"))
+		}
+		if err != nil && len(clients) > 1 {
+			err = fmt.Errorf("client %d: %w", i, err)
+		}
+		result = errors.Join(result, err)
+	}
+
+	return result
+}
+
+func (c Client) validate() error {
+	var result error
+	if c.ClientID == "" {
+		result = errors.Join(result, errors.New("missing client_id"))
+	}
+
+	sources := 0
+	for _, source := range []string{c.ClientSecret, c.ClientSecretEnv, c.ClientSecretFile} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		result = errors.Join(result, errors.New("exactly one of client_secret, client_secret_env and client_secret_file must be set"))
+	}
+
+	for _, scope := range c.Scopes {
+		if strings.TrimSpace(scope) == "" {
+			result = errors.Join(result, errors.New("empty scope"))
+		}
+	}
+
+	return result
+}
+
+// Secret reads the client secret from its source
+func (c Client) Secret() (string, error) {
+	switch {
+	case c.ClientSecretEnv != "":
+		secret, ok := os.LookupEnv(c.ClientSecretEnv)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", c.ClientSecretEnv)
+		}
+		return secret, nil
+	case c.ClientSecretFile != "":
+		contents, err := os.ReadFile(c.ClientSecretFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read client secret: %w", err)
+		}
+		secret := strings.TrimSpace(string(contents))
+		if secret == "" {
+			return "", fmt.Errorf("client secret file %s is empty", c.ClientSecretFile)
+		}
+		return secret, nil
+	default:
+		return c.ClientSecret, nil
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	cases := map[string]struct {
+		contents    string
+		errContains string
+		expected    map[string]Backend
+	}{
+		"defaults": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+client_secret_env = "PROD_SECRET"
+`,
+			expected: map[string]Backend{
+				"prod": {
+					ClientID:        "prod-id",
+					ClientSecretEnv: "PROD_SECRET",
+					TokenURL:        DefaultTokenURL,
+					APIURL:          DefaultAPIURL,
+					Tailnet:         DefaultTailnet,
+				},
+			},
+		},
+		"several backends": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+client_secret_file = "/run/secrets/prod"
+tailnet = "example.com"
+
+[backends.lab]
+client_id = "lab-id"
+client_secret = "lab-secret"
+token_url = "https://lab.example.com/oauth/token"
+api_url = "https://lab.example.com"
+`,
+			expected: map[string]Backend{
+				"prod": {
+					ClientID:         "prod-id",
+					ClientSecretFile: "/run/secrets/prod",
+					TokenURL:         DefaultTokenURL,
+					APIURL:           DefaultAPIURL,
+					Tailnet:          "example.com",
+				},
+				"lab": {
+					ClientID:     "lab-id",
+					ClientSecret: "lab-secret",
+					TokenURL:     "https://lab.example.com/oauth/token",
+					APIURL:       "https://lab.example.com",
+					Tailnet:      DefaultTailnet,
+				},
+			},
+		},
+		"several clients": {
+			contents: `
+[[backends.prod.clients]]
+name = "dns"
+client_id = "dns-id"
+client_secret_env = "DNS_SECRET"
+scopes = ["dns"]
+
+[[backends.prod.clients]]
+client_id = "admin-id"
+client_secret_env = "ADMIN_SECRET"
+token_url = "https://lab.example.com/oauth/token"
+scopes = ["all"]
+`,
+			expected: map[string]Backend{
+				"prod": {
+					Clients: []Client{
+						{Name: "dns", ClientID: "dns-id", ClientSecretEnv: "DNS_SECRET", TokenURL: DefaultTokenURL, Scopes: []string{"dns"}},
+						{Name: "admin-id", ClientID: "admin-id", ClientSecretEnv: "ADMIN_SECRET", TokenURL: "https://lab.example.com/oauth/token", Scopes: []string{"all"}},
+					},
+					APIURL:  DefaultAPIURL,
+					Tailnet: DefaultTailnet,
+				},
+			},
+		},
+		"clients without scopes": {
+			contents: `
+[[backends.prod.clients]]
+client_id = "dns-id"
+client_secret = "secret"
+scopes = ["dns"]
+
+[[backends.prod.clients]]
+client_id = "admin-id"
+client_secret = "secret"
+`,
+			errContains: "backend prod: client 1: missing scopes",
+		},
+		"client fields and clients": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+client_secret = "secret"
+
+[[backends.prod.clients]]
+client_id = "dns-id"
+client_secret = "secret"
+scopes = ["dns"]
+`,
+			errContains: "cannot be combined with clients",
+		},
+		"invalid default backend client": {
+			contents: `
+[[clients]]
+client_id = "dns-id"
+scopes = ["dns"]
+`,
+			errContains: "clients: exactly one of client_secret",
+		},
+		"missing client id": {
+			contents: `
+[backends.prod]
+client_secret = "secret"
+`,
+			errContains: "backend prod: missing client_id",
+		},
+		"no secret source": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+`,
+			errContains: "exactly one of client_secret",
+		},
+		"several secret sources": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+client_secret = "secret"
+client_secret_env = "PROD_SECRET"
+`,
+			errContains: "exactly one of client_secret",
+		},
+		"unknown field": {
+			contents: `
+[backends.prod]
+client_id = "prod-id"
+client_secret = "secret"
+tags = ["tag:ci"]
+`,
+			errContains: "failed to unmarshal config",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.contents), 0o600))
+
+			cfg, err := Load(path)
+			if tc.errContains != "" {
+				require.ErrorContains(t, err, tc.errContains)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg.Backends)
+		})
+	}
+}
+
+func TestLoadClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[[clients]]
+client_id = "dns-id"
+client_secret = "secret"
+scopes = ["dns"]
+
+[backends.lab]
+client_id = "lab-id"
+client_secret = "secret"
+scopes = ["devices:core"]
+`), 0o600))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Client{{Name: "dns-id", ClientID: "dns-id", ClientSecret: "secret", TokenURL: DefaultTokenURL, Scopes: []string{"dns"}}}, cfg.Clients)
+	assert.Equal(t, []Client{{Name: "lab-id", ClientID: "lab-id", ClientSecret: "secret", TokenURL: DefaultTokenURL, Scopes: []string{"devices:core"}}}, cfg.Backends["lab"].OAuthClients())
+}
+
+func TestClientSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0o600))
+	t.Setenv("TAILSTS_TEST_SECRET", "env-secret")
+
+	secret, err := Client{ClientSecret: "inline-secret"}.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "inline-secret", secret)
+
+	secret, err = Client{ClientSecretEnv: "TAILSTS_TEST_SECRET"}.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "env-secret", secret)
+
+	secret, err = Client{ClientSecretFile: secretFile}.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "file-secret", secret)
+
+	_, err = Client{ClientSecretEnv: "TAILSTS_TEST_UNSET"}.Secret()
+	require.ErrorContains(t, err, "is not set")
+
+	_, err = Client{ClientSecretFile: filepath.Join(dir, "missing")}.Secret()
+	require.ErrorContains(t, err, "failed to read client secret")
+}
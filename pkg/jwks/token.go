@@ -3,14 +3,18 @@ package jwks
 import (
 	"crypto/rsa"
 	"fmt"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 func GenerateToken(key *rsa.PrivateKey, issuer, subject, kid string) (string, error) {
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": subject,
 		"iss": issuer,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
 	})
 	token.Header["kid"] = kid
 	signed, err := token.SignedString(key)
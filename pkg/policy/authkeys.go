@@ -0,0 +1,101 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// The Tailscale scope needed to create auth keys
+const AuthKeysScope = "auth_keys"
+
+// The Tailscale scope granting everything, including the creation of auth keys
+const allScope = "all"
+
+// The longest expiry of the auth keys a policy allows when it does not set max_key_expiry
+const defaultMaxKeyExpiry = time.Hour
+
+// The longest expiry Tailscale allows for auth keys, and so the longest max_key_expiry a policy may set
+const TailscaleMaxKeyExpiry = 90 * 24 * time.Hour
+
+var ErrKeyNotAllowed = errors.New("auth key not allowed by policy")
+
+// The properties of a Tailscale auth key being requested
+type KeyRequest struct {
+	Tags          []string
+	Ephemeral     bool
+	Preauthorized bool
+	Reusable      bool
+	// zero means the longest expiry the policy allows
+	Expiry time.Duration
+}
+
+// KeyExpiryLimit returns the longest expiry of the auth keys the policy allows
+func (p Policy) KeyExpiryLimit() time.Duration {
+	if p.MaxKeyExpiry > 0 {
+		return time.Duration(p.MaxKeyExpiry)
+	}
+
+	return defaultMaxKeyExpiry
+}
+
+// AllowsKey checks the properties of an auth key against the policy's limits.
+// A key without an expiry is checked with the expiry it gets, the policy's limit.
+func (p Policy) AllowsKey(key KeyRequest) error {
+	if len(p.AllowedTags) == 0 {
+		return fmt.Errorf("%w: policy allows no tags", ErrKeyNotAllowed)
+	}
+
+	// keys created with an OAuth client must be tagged
+	if len(key.Tags) == 0 {
+		return fmt.Errorf("%w: at least one tag is required", ErrKeyNotAllowed)
+	}
+
+	for _, tag := range key.Tags {
+		if !slices.Contains(p.AllowedTags, tag) {
+			return fmt.Errorf("%w: tag %s not allowed", ErrKeyNotAllowed, tag)
+		}
+	}
+
+	if key.Reusable && !p.AllowReusableKeys {
+		return fmt.Errorf("%w: reusable keys not allowed", ErrKeyNotAllowed)
+	}
+
+	if !key.Ephemeral && !p.AllowNonEphemeralKeys {
+		return fmt.Errorf("%w: non-ephemeral keys not allowed", ErrKeyNotAllowed)
+	}
+
+	if key.Preauthorized && !p.AllowPreauthorizedKeys {
+		return fmt.Errorf("%w: preauthorized keys not allowed", ErrKeyNotAllowed)
+	}
+
+	expiry := key.Expiry
+	if expiry == 0 {
+		expiry = p.KeyExpiryLimit()
+	}
+
+	if expiry <= 0 {
+		return fmt.Errorf("%w: expiry %s is not positive", ErrKeyNotAllowed, expiry)
+	}
+
+	if expiry > p.KeyExpiryLimit() {
+		return fmt.Errorf("%w: expiry %s exceeds %s", ErrKeyNotAllowed, expiry, p.KeyExpiryLimit())
+	}
+
+	return nil
+}
+
+// AllowsAccessToken checks that an access token with the scopes cannot create auth keys beyond the policy's limits.
+// Policies that limit auth keys only let TailSTS create keys on the caller's behalf, and never hand out a token that could create any key.
+func (p Policy) AllowsAccessToken(scopes []string) error {
+	if len(p.AllowedTags) == 0 {
+		return nil
+	}
+
+	if slices.Contains(scopes, AuthKeysScope) || slices.Contains(scopes, allScope) {
+		return fmt.Errorf("%w: the policy limits auth keys, which must be requested as auth keys rather than as an access token", ErrKeyNotAllowed)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowsKey(t *testing.T) {
+	ci := Policy{
+		AllowedScopes: []string{AuthKeysScope},
+		AllowedTags:   StringList{"tag:ci", "tag:runner"},
+		MaxKeyExpiry:  Duration(10 * time.Minute),
+	}
+	permissive := ci
+	permissive.AllowReusableKeys = true
+	permissive.AllowNonEphemeralKeys = true
+	permissive.AllowPreauthorizedKeys = true
+
+	cases := map[string]struct {
+		policy  Policy
+		key     KeyRequest
+		allowed bool
+	}{
+		"allowed tags": {
+			policy:  ci,
+			key:     KeyRequest{Tags: []string{"tag:ci", "tag:runner"}, Ephemeral: true},
+			allowed: true,
+		},
+		"tag not allowed": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci", "tag:prod"}, Ephemeral: true},
+		},
+		"no tags": {
+			policy: ci,
+			key:    KeyRequest{Ephemeral: true},
+		},
+		"policy without allowed tags": {
+			policy: Policy{AllowedScopes: []string{AuthKeysScope}},
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true},
+		},
+		"reusable": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Reusable: true},
+		},
+		"non-ephemeral": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci"}},
+		},
+		"preauthorized": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Preauthorized: true},
+		},
+		"everything allowed": {
+			policy:  permissive,
+			key:     KeyRequest{Tags: []string{"tag:ci"}, Reusable: true, Preauthorized: true},
+			allowed: true,
+		},
+		"expiry within limit": {
+			policy:  ci,
+			key:     KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Expiry: 10 * time.Minute},
+			allowed: true,
+		},
+		"expiry too long": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Expiry: time.Hour},
+		},
+		"negative expiry": {
+			policy: ci,
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Expiry: -time.Second},
+		},
+		"expiry beyond the default limit": {
+			policy: Policy{AllowedScopes: []string{AuthKeysScope}, AllowedTags: StringList{"tag:ci"}},
+			key:    KeyRequest{Tags: []string{"tag:ci"}, Ephemeral: true, Expiry: 2 * time.Hour},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.policy.AllowsKey(tc.key)
+			if tc.allowed {
+				require.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrKeyNotAllowed)
+		})
+	}
+}
+
+func TestAllowsAccessToken(t *testing.T) {
+	ci := Policy{
+		AllowedScopes: []string{AuthKeysScope, "devices:core:read", "all"},
+		AllowedTags:   StringList{"tag:ci"},
+	}
+	unlimited := Policy{AllowedScopes: []string{AuthKeysScope}}
+
+	cases := map[string]struct {
+		policy  Policy
+		scopes  []string
+		allowed bool
+	}{
+		"other scopes":              {policy: ci, scopes: []string{"devices:core:read"}, allowed: true},
+		"auth_keys":                 {policy: ci, scopes: []string{AuthKeysScope}},
+		"auth_keys among others":    {policy: ci, scopes: []string{"devices:core:read", AuthKeysScope}},
+		"all":                       {policy: ci, scopes: []string{"all"}},
+		"policy without key limits": {policy: unlimited, scopes: []string{AuthKeysScope}, allowed: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.policy.AllowsAccessToken(tc.scopes)
+			if tc.allowed {
+				require.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrKeyNotAllowed)
+		})
+	}
+}
+
+func TestKeyExpiryLimit(t *testing.T) {
+	assert.Equal(t, time.Hour, Policy{}.KeyExpiryLimit())
+	assert.Equal(t, 5*time.Minute, Policy{MaxKeyExpiry: Duration(5 * time.Minute)}.KeyExpiryLimit())
+}
@@ -0,0 +1,226 @@
+package policy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Persists the last JWKS fetched for each policy, so that after a restart tokens can be verified
+// before the JWKS endpoints are reached again. Snapshots older than maxStaleness are not used.
+// A nil cache stores nothing.
+type JwksCache struct {
+	dir          string
+	maxStaleness time.Duration
+}
+
+func NewJwksCache(dir string, maxStaleness time.Duration) *JwksCache {
+	return &JwksCache{
+		dir:          dir,
+		maxStaleness: maxStaleness,
+	}
+}
+
+// The on-disk form of a JWKS snapshot
+type jwksSnapshot struct {
+	Issuer    string          `json:"issuer"`
+	JwksURL   string          `json:"jwks_url"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	Jwks      json.RawMessage `json:"jwks"`
+	// the signing algorithms the issuer advertised, if its JWKS URL was discovered
+	Algorithms []string `json:"algorithms,omitempty"`
+}
+
+// A snapshot loaded from the cache
+type cachedKeys struct {
+	jwks       keyfunc.Keyfunc
+	fetchedAt  time.Time
+	algorithms []string
+}
+
+// snapshotPath names a policy's snapshot after its issuer and configured JWKS URL, so that renaming
+// a policy keeps its snapshot and pointing it at other keys does not.
+func (c *JwksCache) snapshotPath(p Policy) string {
+	sum := sha256.Sum256([]byte(p.Issuer + "\n" + p.JwksURL))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load reads the policy's snapshot. It returns nil if there is none or it is too stale to use.
+func (c *JwksCache) load(p Policy) (*cachedKeys, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(c.snapshotPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS snapshot: %w", err)
+	}
+
+	var snapshot jwksSnapshot
+	err = json.Unmarshal(contents, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS snapshot: %w", err)
+	}
+
+	if !c.fresh(snapshot.FetchedAt) {
+		return nil, nil
+	}
+
+	jwks, err := keyfunc.NewJWKSetJSON(snapshot.Jwks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS snapshot: %w", err)
+	}
+
+	return &cachedKeys{jwks: jwks, fetchedAt: snapshot.FetchedAt, algorithms: snapshot.Algorithms}, nil
+}
+
+// save writes the policy's keys as its snapshot. p must be the policy as configured, before its JWKS URL was discovered.
+func (c *JwksCache) save(ctx context.Context, p Policy, jwks keyfunc.Keyfunc) error {
+	if c == nil {
+		return nil
+	}
+
+	raw, err := jwks.Storage().JSONPublic(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JWKS: %w", err)
+	}
+
+	snapshot := jwksSnapshot{
+		Issuer:    p.Issuer,
+		JwksURL:   p.JwksURL,
+		FetchedAt: time.Now().UTC(),
+		Jwks:      raw,
+	}
+	// the snapshot stands in for the keys, so it restricts algorithms as they do
+	if keys, ok := jwks.(advertisingKeys); ok {
+		snapshot.Algorithms = keys.advertisedAlgorithms()
+	}
+
+	contents, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode JWKS snapshot: %w", err)
+	}
+
+	err = os.MkdirAll(c.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// write to a temporary file first, so a crash never leaves a partial snapshot behind
+	tmp, err := os.CreateTemp(c.dir, ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to create JWKS snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(contents)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write JWKS snapshot: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write JWKS snapshot: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), c.snapshotPath(p))
+	if err != nil {
+		return fmt.Errorf("failed to write JWKS snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// The keys fetched from a JWKS endpoint, which keyfunc refreshes in the background every jwksRefreshInterval
+type remoteKeys struct {
+	keys keyfunc.Keyfunc
+	// the signing algorithms advertised by the issuer's discovery document.
+	// nil if the JWKS URL was not discovered or the document advertises none, which restricts no algorithm
+	algorithms []string
+	// set when a refresh fails, and cleared once the failure has kept a snapshot from being taken
+	refreshFailed atomic.Bool
+}
+
+var _ keyfunc.Keyfunc = (*remoteKeys)(nil)
+
+func (k *remoteKeys) Keyfunc(token *jwt.Token) (any, error) {
+	return k.keys.Keyfunc(token)
+}
+
+func (k *remoteKeys) KeyfuncCtx(ctx context.Context) jwt.Keyfunc {
+	return k.keys.KeyfuncCtx(ctx)
+}
+
+func (k *remoteKeys) Storage() jwkset.Storage {
+	return k.keys.Storage()
+}
+
+func (k *remoteKeys) advertisedAlgorithms() []string {
+	return k.algorithms
+}
+
+func (k *remoteKeys) VerificationKeySet(ctx context.Context) (jwt.VerificationKeySet, error) {
+	return k.keys.VerificationKeySet(ctx)
+}
+
+// persistRefreshes snapshots keys fetched from a JWKS endpoint after each of their background refreshes, until ctx is done.
+// Snapshots are taken a JWKS timeout after every refresh, once the refresh has had time to finish.
+func (c *JwksCache) persistRefreshes(ctx context.Context, logger *slog.Logger, p Policy, jwks keyfunc.Keyfunc) {
+	keys, ok := jwks.(*remoteKeys)
+	if c == nil || !ok {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(jwksTimeout):
+	}
+
+	ticker := time.NewTicker(jwksRefreshInterval)
+	defer ticker.Stop()
+
+	c.persist(ctx, logger, p, keys, ticker.C)
+}
+
+// persist snapshots the keys on every tick, unless a refresh failed since the previous tick.
+// The snapshot then keeps the time of the last successful refresh, so that keys the issuer no longer serves grow stale.
+func (c *JwksCache) persist(ctx context.Context, logger *slog.Logger, p Policy, keys *remoteKeys, ticks <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+
+		if keys.refreshFailed.Swap(false) {
+			continue
+		}
+
+		err := c.save(ctx, p, keys)
+		if err != nil {
+			logger.Warn("Failed to save JWKS snapshot", "policy", p.Name, "error", err)
+		}
+	}
+}
+
+// Whether a snapshot fetched at fetchedAt may still be used
+func (c *JwksCache) fresh(fetchedAt time.Time) bool {
+	return time.Since(fetchedAt) <= c.maxStaleness
+}
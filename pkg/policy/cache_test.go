@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJwksCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	key := generateRSAKey(t)
+	handler := jwks.NewJWKSHandler(logger, key, "test")
+
+	// an issuer that can be taken down
+	var up atomic.Bool
+	up.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	writePolicy(t, dir, "policy.toml", srv.URL+"/jwks", `["acls"]`)
+
+	token, err := jwks.GenerateToken(key, "http://localhost:8888", "subject", "test")
+	require.NoError(t, err)
+
+	verify := func(p Policy) error {
+		_, err := jwt.Parse(token, p.Jwks.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+		return err
+	}
+
+	cacheDir := t.TempDir()
+	cache := NewJwksCache(cacheDir, time.Hour)
+
+	// the first start fetches the JWKS and snapshots it
+	firstCtx, cancelFirst := context.WithCancel(t.Context())
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, cache)
+	require.NoError(t, reloader.Reload(firstCtx))
+	policies := reloader.Store().Policies()
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(cacheDir)
+		return err == nil && len(entries) == 1 && policies[0].KeysHealth().Loaded
+	}, 5*time.Second, 10*time.Millisecond)
+	cancelFirst()
+
+	// after a restart with the issuer down, the snapshot verifies tokens
+	up.Store(false)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	reloader = NewReloader(logger, dir, ReadOptions{}, nil, cache)
+	require.NoError(t, reloader.Reload(ctx))
+	policies = reloader.Store().Policies()
+
+	health := policies[0].KeysHealth()
+	assert.False(t, health.Loaded)
+	assert.False(t, health.SnapshotFetchedAt.IsZero())
+	require.NoError(t, verify(policies[0]))
+
+	// a snapshot older than the maximum staleness is not used
+	reloader = NewReloader(logger, dir, ReadOptions{}, nil, NewJwksCache(cacheDir, time.Nanosecond))
+	require.NoError(t, reloader.Reload(ctx))
+	stale := reloader.Store().Policies()
+	assert.Zero(t, stale[0].KeysHealth().SnapshotFetchedAt)
+	require.ErrorIs(t, verify(stale[0]), ErrJWKSUnavailable)
+
+	// the JWKS replaces the snapshot once it is fetched
+	up.Store(true)
+	assert.Eventually(t, func() bool {
+		return policies[0].KeysHealth().Loaded
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Zero(t, policies[0].KeysHealth().SnapshotFetchedAt)
+	require.NoError(t, verify(policies[0]))
+}
+
+func TestJwksCachePersist(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ctx := t.Context()
+	jwksURL := spawnJwksServer(t, logger)
+
+	p := Policy{Name: "policy", Issuer: "http://localhost:8888", JwksURL: jwksURL}
+	loaded := p
+	require.NoError(t, loaded.LoadJwks(ctx, logger))
+	keys, ok := loaded.Jwks.(*remoteKeys)
+	require.True(t, ok)
+
+	cache := NewJwksCache(t.TempDir(), time.Hour)
+	fetchedAt := func() time.Time {
+		contents, err := os.ReadFile(cache.snapshotPath(p))
+		if err != nil {
+			return time.Time{}
+		}
+		var snapshot jwksSnapshot
+		require.NoError(t, json.Unmarshal(contents, &snapshot))
+		return snapshot.FetchedAt
+	}
+
+	ticks := make(chan time.Time)
+	go cache.persist(ctx, logger, p, keys, ticks)
+
+	// the keys are snapshotted after a refresh
+	ticks <- time.Now()
+	require.Eventually(t, func() bool {
+		return !fetchedAt().IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	first := fetchedAt()
+
+	// but not after a failed refresh, so the snapshot keeps the time of the last successful one
+	keys.refreshFailed.Store(true)
+	ticks <- time.Now()
+	require.Eventually(t, func() bool {
+		return !keys.refreshFailed.Load()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, first, fetchedAt())
+
+	ticks <- time.Now()
+	assert.Eventually(t, func() bool {
+		return fetchedAt().After(first)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestJwksCacheAdvertisedAlgorithms(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ctx := t.Context()
+	jwksURL := spawnJwksServer(t, logger)
+
+	p := Policy{Name: "policy", Issuer: "http://localhost:8888", JwksURL: jwksURL}
+	loaded := p
+	require.NoError(t, loaded.LoadJwks(ctx, logger))
+	keys, ok := loaded.Jwks.(*remoteKeys)
+	require.True(t, ok)
+	keys.algorithms = []string{"ES256"}
+
+	cache := NewJwksCache(t.TempDir(), time.Hour)
+	require.NoError(t, cache.save(ctx, p, keys))
+
+	snapshot, err := cache.load(p)
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+
+	// a snapshot standing in for the keys refuses the algorithms the issuer did not advertise
+	pending := &pendingKeys{cache: cache, snapshot: snapshot}
+	assert.Equal(t, []string{"ES256"}, pending.advertisedAlgorithms())
+
+	token, err := jwks.GenerateToken(generateRSAKey(t), "http://localhost:8888", "subject", "test")
+	require.NoError(t, err)
+	_, err = jwt.Parse(token, Policy{Algorithms: StringList{"RS256"}, Jwks: pending}.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+	require.ErrorIs(t, err, ErrAlgorithmNotAdvertised)
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+var ErrConditionNotMet = errors.New("condition not met")
+
+// ErrConditionFailed is wrapped along with ErrConditionNotMet when the condition could not be evaluated, as opposed to evaluating to false
+var ErrConditionFailed = errors.New("condition could not be evaluated")
+
+// The CEL environment condition expressions are checked against.
+// Expressions can refer to the verified token claims, the requested scopes and metadata about the request.
+var conditionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("scopes", cel.ListType(cel.StringType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.StringType)),
+	)
+})
+
+// Metadata about the request a token is presented in, available to condition expressions as `request`
+type RequestMetadata struct {
+	RemoteAddr string
+	Host       string
+	Method     string
+	Path       string
+	UserAgent  string
+}
+
+func (r RequestMetadata) toMap() map[string]string {
+	return map[string]string{
+		"remote_addr": r.RemoteAddr,
+		"host":        r.Host,
+		"method":      r.Method,
+		"path":        r.Path,
+		"user_agent":  r.UserAgent,
+	}
+}
+
+// compileCondition parses and type-checks a condition expression, which must evaluate to a bool
+func compileCondition(expression string) (cel.Program, error) {
+	env, err := conditionEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("condition must evaluate to a bool, found %s", ast.OutputType())
+	}
+
+	return env.Program(ast)
+}
+
+// evalCondition runs a compiled condition. Evaluation errors, such as a reference to a missing claim, count as the condition not being met,
+// and are reported with ErrConditionFailed so that deny policies can fail closed.
+func evalCondition(program cel.Program, in Input) error {
+	out, _, err := program.Eval(map[string]any{
+		"claims":  map[string]any(in.Claims),
+		"scopes":  in.Scopes,
+		"request": in.Request.toMap(),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrConditionNotMet, ErrConditionFailed, err)
+	}
+
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return fmt.Errorf("%w: %w: evaluated to %v", ErrConditionNotMet, ErrConditionFailed, out.Value())
+	}
+	if !allowed {
+		return ErrConditionNotMet
+	}
+
+	return nil
+}
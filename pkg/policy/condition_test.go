@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileCondition(t *testing.T) {
+	cases := map[string]struct {
+		expression string
+		err        string
+	}{
+		"claims comparison": {
+			expression: `claims.environment != "prod" || claims.ref == "refs/heads/main"`,
+		},
+		"scopes and request metadata": {
+			expression: `!("acls" in scopes) || request.user_agent.startsWith("ci/")`,
+		},
+		"syntax error": {
+			expression: `claims.environment ==`,
+			err:        "Syntax error",
+		},
+		"unknown variable": {
+			expression: `token.environment == "prod"`,
+			err:        "undeclared reference to 'token'",
+		},
+		"non-bool result": {
+			expression: `request.host`,
+			err:        "condition must evaluate to a bool",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := compileCondition(tc.expression)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestMatchCondition(t *testing.T) {
+	prodRequiresMain := `claims.environment != "prod" || claims.ref == "refs/heads/main"`
+
+	cases := map[string]struct {
+		condition string
+		input     Input
+		matches   bool
+		// the condition could not be evaluated, rather than evaluating to false
+		failed bool
+	}{
+		"no condition": {
+			condition: "",
+			input:     Input{},
+			matches:   true,
+		},
+		"prod from main": {
+			condition: prodRequiresMain,
+			input:     Input{Claims: jwt.MapClaims{"environment": "prod", "ref": "refs/heads/main"}},
+			matches:   true,
+		},
+		"prod from a branch": {
+			condition: prodRequiresMain,
+			input:     Input{Claims: jwt.MapClaims{"environment": "prod", "ref": "refs/heads/feature"}},
+			matches:   false,
+		},
+		"staging from a branch": {
+			condition: prodRequiresMain,
+			input:     Input{Claims: jwt.MapClaims{"environment": "staging", "ref": "refs/heads/feature"}},
+			matches:   true,
+		},
+		"missing claim does not match": {
+			condition: prodRequiresMain,
+			input:     Input{Claims: jwt.MapClaims{"ref": "refs/heads/feature"}},
+			matches:   false,
+			failed:    true,
+		},
+		"claim of an unexpected type": {
+			condition: `claims.run_attempt > 1`,
+			input:     Input{Claims: jwt.MapClaims{"run_attempt": "2"}},
+			matches:   false,
+			failed:    true,
+		},
+		"requested scopes": {
+			condition: `scopes.all(s, s.endsWith(":read"))`,
+			input:     Input{Scopes: []string{"devices:read", "acls"}},
+			matches:   false,
+		},
+		"request metadata": {
+			condition: `request.host == "tailsts.internal"`,
+			input:     Input{Request: RequestMetadata{Host: "tailsts.internal"}},
+			matches:   true,
+		},
+		"numeric claims": {
+			condition: `claims.run_attempt == 1`,
+			input:     Input{Claims: jwt.MapClaims{"run_attempt": float64(1)}},
+			matches:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := Policy{Condition: tc.condition}
+			require.NoError(t, p.Compile())
+
+			err := p.MatchCondition(tc.input)
+			if tc.matches {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrConditionNotMet)
+			}
+
+			if tc.failed {
+				assert.ErrorIs(t, err, ErrConditionFailed)
+			} else {
+				assert.NotErrorIs(t, err, ErrConditionFailed)
+			}
+		})
+	}
+}
+
+func TestMatchConditionNotCompiled(t *testing.T) {
+	p := Policy{Condition: `true`}
+
+	err := p.MatchCondition(Input{})
+	assert.ErrorIs(t, err, ErrConditionNotMet)
+	assert.ErrorIs(t, err, ErrConditionFailed)
+}
@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const discoveryTimeout = 10 * time.Second
+
+// The fields of an OpenID Provider's discovery document that TailSTS relies on
+type discoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JwksURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+func discoveryURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+}
+
+// ErrAlgorithmNotAdvertised is returned for tokens signed with an algorithm the policy allows, but the issuer's discovery document does not advertise
+var ErrAlgorithmNotAdvertised = errors.New("signing algorithm not advertised by the issuer")
+
+// discoverJwksURL resolves the JWKS URL of the policy's issuer from its OpenID discovery document, along with the signing algorithms it advertises.
+// The document must be published by the policy's issuer.
+func (p Policy) discoverJwksURL(ctx context.Context) (string, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL(p.Issuer), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to fetch discovery document: %s", resp.Status)
+	}
+
+	var doc discoveryDocument
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+
+	if doc.Issuer != p.Issuer {
+		return "", nil, fmt.Errorf("discovery document issuer %q does not match policy issuer %q", doc.Issuer, p.Issuer)
+	}
+
+	if doc.JwksURI == "" {
+		return "", nil, fmt.Errorf("discovery document has no jwks_uri")
+	}
+
+	return doc.JwksURI, doc.IDTokenSigningAlgValuesSupported, nil
+}
+
+// unadvertisedAlgorithms returns the algorithms the policy allows that its issuer does not advertise
+func (p Policy) unadvertisedAlgorithms(advertised []string) []string {
+	var missing []string
+	for _, alg := range p.Algorithms {
+		if !slices.Contains(advertised, alg) {
+			missing = append(missing, alg)
+		}
+	}
+
+	return missing
+}
+
+// Keys that know which signing algorithms their issuer advertises
+type advertisingKeys interface {
+	advertisedAlgorithms() []string
+}
+
+// checkAdvertised refuses tokens signed with an algorithm that the policy's issuer does not advertise.
+// Keys that advertise no algorithms, because their JWKS URL was not discovered or their issuer lists none, accept every algorithm the policy allows.
+func (p Policy) checkAdvertised(token *jwt.Token) error {
+	keys, ok := p.Jwks.(advertisingKeys)
+	if !ok {
+		return nil
+	}
+
+	advertised := keys.advertisedAlgorithms()
+	if advertised == nil || slices.Contains(advertised, token.Method.Alg()) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s, advertised algorithms: %v", ErrAlgorithmNotAdvertised, token.Method.Alg(), advertised)
+}
@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadJwksDiscovery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		// builds the discovery document served by an issuer at issuerURL
+		document  func(issuerURL string) *discoveryDocument
+		algorithm string
+		jwksURL   func(issuerURL string) string
+		err       string
+		// the error a token signed with RS256 fails verification with, once the keys have loaded
+		verifyErr error
+	}{
+		"jwks url discovered": {
+			document: func(issuerURL string) *discoveryDocument {
+				return &discoveryDocument{Issuer: issuerURL, JwksURI: issuerURL + "/jwks", IDTokenSigningAlgValuesSupported: []string{"RS256"}}
+			},
+			algorithm: "RS256",
+		},
+		"explicit jwks url skips discovery": {
+			document:  nil,
+			algorithm: "RS256",
+			jwksURL:   func(issuerURL string) string { return issuerURL + "/jwks" },
+		},
+		"no discovery document": {
+			document:  nil,
+			algorithm: "RS256",
+			err:       "404 Not Found",
+		},
+		"issuer mismatch": {
+			document: func(issuerURL string) *discoveryDocument {
+				return &discoveryDocument{Issuer: "https://evil.example.com", JwksURI: issuerURL + "/jwks", IDTokenSigningAlgValuesSupported: []string{"RS256"}}
+			},
+			algorithm: "RS256",
+			err:       "does not match policy issuer",
+		},
+		"algorithm not advertised": {
+			document: func(issuerURL string) *discoveryDocument {
+				return &discoveryDocument{Issuer: issuerURL, JwksURI: issuerURL + "/jwks", IDTokenSigningAlgValuesSupported: []string{"ES256"}}
+			},
+			algorithm: "RS256",
+			verifyErr: ErrAlgorithmNotAdvertised,
+		},
+		"no algorithms advertised": {
+			document: func(issuerURL string) *discoveryDocument {
+				return &discoveryDocument{Issuer: issuerURL, JwksURI: issuerURL + "/jwks"}
+			},
+			algorithm: "RS256",
+		},
+		"no jwks uri": {
+			document: func(issuerURL string) *discoveryDocument {
+				return &discoveryDocument{Issuer: issuerURL, IDTokenSigningAlgValuesSupported: []string{"RS256"}}
+			},
+			algorithm: "RS256",
+			err:       "discovery document has no jwks_uri",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("GET /jwks", jwks.NewJWKSHandler(logger, key, "test"))
+			srv := httptest.NewServer(mux)
+			t.Cleanup(srv.Close)
+
+			if tc.document != nil {
+				doc := tc.document(srv.URL)
+				mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					assert.NoError(t, json.NewEncoder(w).Encode(doc))
+				})
+			}
+
+			p := Policy{
+				Issuer:        srv.URL,
+				Algorithms:    StringList{tc.algorithm},
+				AllowedScopes: []string{"acls"},
+			}
+			if tc.jwksURL != nil {
+				p.JwksURL = tc.jwksURL(srv.URL)
+			}
+
+			err := p.LoadJwks(t.Context(), logger)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.NotNil(t, p.Jwks)
+			assert.Equal(t, srv.URL+"/jwks", p.JwksURL)
+
+			token, err := jwks.GenerateToken(key, srv.URL, "subject", "test")
+			require.NoError(t, err)
+			_, err = jwt.Parse(token, p.Keyfunc, p.ParserOptions()...)
+			if tc.verifyErr != nil {
+				require.ErrorIs(t, err, tc.verifyErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
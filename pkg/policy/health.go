@@ -0,0 +1,254 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrJWKSUnavailable = errors.New("JWKS not loaded")
+
+// How long a single JWKS fetch may take
+const jwksTimeout = 10 * time.Second
+
+// How often the JWKS fetched from a JWKS endpoint are refreshed in the background
+const jwksRefreshInterval = time.Hour
+
+// Bounds of the backoff between attempts to load keys that failed to load.
+// A request for the keys prompts an earlier attempt, but never sooner than jwksRetryMin after the previous one.
+const (
+	jwksRetryMin = time.Second
+	jwksRetryMax = time.Minute
+)
+
+// The state of a policy's keys
+type KeysHealth struct {
+	Loaded bool
+	// when the snapshot standing in for the keys until they load was fetched, zero if no snapshot is in use
+	SnapshotFetchedAt time.Time
+	// the error of the last failed attempt to load the keys, if they are not loaded
+	LastError   error
+	LastAttempt time.Time
+}
+
+// Reports whether the policy's keys are loaded, and why not if they are not
+func (p Policy) KeysHealth() KeysHealth {
+	if pending, ok := p.Jwks.(*pendingKeys); ok {
+		return pending.health()
+	}
+
+	return KeysHealth{Loaded: p.Jwks != nil}
+}
+
+// loadKeys loads the policy's keys without waiting on its issuer. Keys supplied by the policy are loaded right away,
+// while keys fetched from a JWKS endpoint are fetched in the background, and retried until they load.
+// Until then, a snapshot of the keys in the cache is used if there is one.
+func (p *Policy) loadKeys(ctx context.Context, logger *slog.Logger, cache *JwksCache) {
+	if p.hasStaticKeys() {
+		configured := *p
+		err := p.LoadJwks(ctx, logger)
+		if err != nil {
+			logger.Warn("Failed to load keys, retrying in the background", "policy", p.Name, "error", err)
+			p.Jwks = newPendingKeys(ctx, logger, configured, cache, nil, err)
+		}
+		return
+	}
+
+	snapshot, err := cache.load(*p)
+	if err != nil {
+		logger.Warn("Failed to load JWKS snapshot", "policy", p.Name, "error", err)
+	}
+
+	if snapshot != nil {
+		logger.Info("Using JWKS snapshot until the JWKS is fetched", "policy", p.Name, "fetchedAt", snapshot.fetchedAt)
+	}
+
+	// the keys are fetched with a copy of the policy, so the policy keeps its configured JWKS URL, which snapshots are keyed by
+	p.Jwks = newPendingKeys(ctx, logger, *p, cache, snapshot, nil)
+}
+
+// Stands in for the keys of a policy while they are loaded in the background.
+// Until then, a snapshot of the keys is used if there is one that is not too stale.
+type pendingKeys struct {
+	cache *JwksCache
+
+	mu       sync.RWMutex
+	jwks     keyfunc.Keyfunc
+	snapshot *cachedKeys
+	status   KeysHealth
+
+	// prompts a retry when a request needs the keys
+	wake chan struct{}
+}
+
+var _ keyfunc.Keyfunc = (*pendingKeys)(nil)
+
+// newPendingKeys loads the policy's keys in the background until they load or ctx is done.
+// err is the error of the attempt that already failed, if any. Without one, the first attempt is made right away.
+func newPendingKeys(ctx context.Context, logger *slog.Logger, p Policy, cache *JwksCache, snapshot *cachedKeys, err error) *pendingKeys {
+	k := &pendingKeys{
+		cache:    cache,
+		snapshot: snapshot,
+		wake:     make(chan struct{}, 1),
+	}
+
+	if snapshot != nil {
+		k.status.SnapshotFetchedAt = snapshot.fetchedAt
+	}
+
+	if err != nil {
+		k.status.LastError = err
+		k.status.LastAttempt = time.Now()
+	}
+
+	go k.retry(ctx, logger, p, err == nil)
+
+	return k
+}
+
+func (k *pendingKeys) retry(ctx context.Context, logger *slog.Logger, p Policy, immediate bool) {
+	backoff := 2 * jwksRetryMin
+	for {
+		if !immediate {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jwksRetryMin):
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff - jwksRetryMin):
+			case <-k.wake:
+			}
+		}
+		immediate = false
+
+		attempt := p
+		err := attempt.LoadJwks(ctx, logger)
+
+		k.mu.Lock()
+		k.status.LastAttempt = time.Now()
+		if err == nil {
+			k.jwks = attempt.Jwks
+			k.snapshot = nil
+			k.status = KeysHealth{Loaded: true, LastAttempt: k.status.LastAttempt}
+		} else {
+			k.status.LastError = err
+		}
+		k.mu.Unlock()
+
+		if err == nil {
+			logger.Info("JWKS loaded", "policy", p.Name)
+
+			err = k.cache.save(ctx, p, attempt.Jwks)
+			if err != nil {
+				logger.Warn("Failed to save JWKS snapshot", "policy", p.Name, "error", err)
+			}
+
+			k.cache.persistRefreshes(ctx, logger, p, attempt.Jwks)
+			return
+		}
+
+		logger.Warn("Failed to load JWKS, retrying in the background", "policy", p.Name, "error", err, "retryIn", backoff)
+		backoff = min(2*backoff, jwksRetryMax)
+	}
+}
+
+func (k *pendingKeys) health() KeysHealth {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.status
+}
+
+// loaded returns the keys once they are loaded, or the snapshot standing in for them.
+// Without either it prompts a retry and returns ErrJWKSUnavailable.
+func (k *pendingKeys) loaded() (keyfunc.Keyfunc, error) {
+	k.mu.RLock()
+	jwks, snapshot, lastErr := k.jwks, k.snapshot, k.status.LastError
+	k.mu.RUnlock()
+
+	if jwks != nil {
+		return jwks, nil
+	}
+
+	if snapshot != nil && k.cache.fresh(snapshot.fetchedAt) {
+		return snapshot.jwks, nil
+	}
+
+	select {
+	case k.wake <- struct{}{}:
+	default:
+	}
+
+	if lastErr == nil {
+		return nil, fmt.Errorf("%w: the JWKS is still being fetched", ErrJWKSUnavailable)
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrJWKSUnavailable, lastErr)
+}
+
+func (k *pendingKeys) Keyfunc(token *jwt.Token) (any, error) {
+	jwks, err := k.loaded()
+	if err != nil {
+		return nil, err
+	}
+
+	return jwks.Keyfunc(token)
+}
+
+func (k *pendingKeys) KeyfuncCtx(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		jwks, err := k.loaded()
+		if err != nil {
+			return nil, err
+		}
+
+		return jwks.KeyfuncCtx(ctx)(token)
+	}
+}
+
+// advertisedAlgorithms are those of the loaded keys, or of the snapshot standing in for them.
+// Keys that are not loaded yet advertise none.
+func (k *pendingKeys) advertisedAlgorithms() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if keys, ok := k.jwks.(advertisingKeys); ok {
+		return keys.advertisedAlgorithms()
+	}
+
+	if k.snapshot != nil {
+		return k.snapshot.algorithms
+	}
+
+	return nil
+}
+
+// Storage is empty until the keys are loaded
+func (k *pendingKeys) Storage() jwkset.Storage {
+	jwks, err := k.loaded()
+	if err != nil {
+		return jwkset.NewMemoryStorage()
+	}
+
+	return jwks.Storage()
+}
+
+func (k *pendingKeys) VerificationKeySet(ctx context.Context) (jwt.VerificationKeySet, error) {
+	jwks, err := k.loaded()
+	if err != nil {
+		return jwt.VerificationKeySet{}, err
+	}
+
+	return jwks.VerificationKeySet(ctx)
+}
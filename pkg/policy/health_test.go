@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadWithUnavailableJwks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	key := generateRSAKey(t)
+	handler := jwks.NewJWKSHandler(logger, key, "test")
+
+	// an issuer that is down until up is set
+	var up atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(flaky.Close)
+
+	dir := t.TempDir()
+	writePolicy(t, dir, "healthy.toml", spawnJwksServer(t, logger), `["acls"]`)
+	writePolicy(t, dir, "flaky.toml", flaky.URL+"/jwks", `["acls"]`)
+
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, nil)
+	require.NoError(t, reloader.Reload(ctx))
+	policies := reloader.Store().Policies()
+	require.Len(t, policies, 2)
+
+	// policies are read in lexical order
+	flakyPolicy, healthyPolicy := policies[0], policies[1]
+	require.Eventually(t, func() bool {
+		return healthyPolicy.KeysHealth().Loaded && flakyPolicy.KeysHealth().LastError != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	health := flakyPolicy.KeysHealth()
+	assert.False(t, health.Loaded)
+	assert.False(t, health.LastAttempt.IsZero())
+
+	token, err := jwks.GenerateToken(key, "http://localhost:8888", "subject", "test")
+	require.NoError(t, err)
+
+	_, err = jwt.Parse(token, flakyPolicy.Jwks.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+	require.ErrorIs(t, err, ErrJWKSUnavailable)
+
+	up.Store(true)
+	assert.Eventually(t, func() bool {
+		return flakyPolicy.KeysHealth().Loaded
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = jwt.Parse(token, flakyPolicy.Jwks.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+	require.NoError(t, err)
+	assert.NoError(t, flakyPolicy.KeysHealth().LastError)
+}
@@ -0,0 +1,276 @@
+package policy
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How often key files are re-read when the policy does not set key_refresh_interval
+const defaultKeyRefreshInterval = 5 * time.Minute
+
+// Whether the policy supplies its own keys rather than fetching them from a JWKS endpoint
+func (p Policy) hasStaticKeys() bool {
+	return p.JwksInline != "" || p.JwksFile != "" || len(p.PublicKeys) > 0 || len(p.PublicKeyFiles) > 0
+}
+
+func (p Policy) hasKeyFiles() bool {
+	return p.JwksFile != "" || len(p.PublicKeyFiles) > 0
+}
+
+func (p Policy) keyRefreshInterval() time.Duration {
+	if p.KeyRefreshInterval <= 0 {
+		return defaultKeyRefreshInterval
+	}
+
+	return time.Duration(p.KeyRefreshInterval)
+}
+
+// keySource identifies where the policy's keys come from, as configured. Reloads keep the keys of a policy whose key source did not change.
+func (p Policy) keySource() string {
+	return fmt.Sprintf("%q %q %q %q %q %q %d", p.Issuer, p.JwksURL, p.JwksInline, p.JwksFile, p.PublicKeys, p.PublicKeyFiles, p.KeyRefreshInterval)
+}
+
+// resolveKeyFiles makes relative key file paths relative to the directory of the policy that names them
+func (p *Policy) resolveKeyFiles(dir string) {
+	if p.JwksFile != "" && !filepath.IsAbs(p.JwksFile) {
+		p.JwksFile = filepath.Join(dir, p.JwksFile)
+	}
+
+	for i, file := range p.PublicKeyFiles {
+		if !filepath.IsAbs(file) {
+			p.PublicKeyFiles[i] = filepath.Join(dir, file)
+		}
+	}
+}
+
+// loadStaticKeys builds a key set from the keys supplied by the policy.
+// Key files are re-read every key_refresh_interval until ctx is done. If a file cannot be read, the previous keys are kept.
+func (p Policy) loadStaticKeys(ctx context.Context, logger *slog.Logger) (keyfunc.Keyfunc, error) {
+	keys, err := p.readStaticKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	storage := jwkset.NewMemoryStorage()
+	err = storage.KeyReplaceAll(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store keys: %w", err)
+	}
+
+	kf, err := keyfunc.New(keyfunc.Options{Ctx: ctx, Storage: storage})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keyfunc: %w", err)
+	}
+
+	if p.hasKeyFiles() {
+		go p.refreshStaticKeys(ctx, logger, storage)
+	}
+
+	return staticKeyfunc{keys: kf}, nil
+}
+
+func (p Policy) refreshStaticKeys(ctx context.Context, logger *slog.Logger, storage *jwkset.MemoryJWKSet) {
+	ticker := time.NewTicker(p.keyRefreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys, err := p.readStaticKeys()
+			if err != nil {
+				logger.Error("Failed to refresh keys, keeping the previous keys", "policy", p.Name, "error", err)
+				continue
+			}
+
+			err = storage.KeyReplaceAll(ctx, keys)
+			if err != nil {
+				logger.Error("Failed to store refreshed keys", "policy", p.Name, "error", err)
+				continue
+			}
+
+			logger.Debug("Keys refreshed", "policy", p.Name, "count", len(keys))
+		}
+	}
+}
+
+// readStaticKeys reads every key supplied by the policy, inline or from files
+func (p Policy) readStaticKeys() ([]jwkset.JWK, error) {
+	var keys []jwkset.JWK
+	if p.JwksInline != "" {
+		jwks, err := parseJWKS([]byte(p.JwksInline))
+		if err != nil {
+			return nil, fmt.Errorf("invalid inline JWKS: %w", err)
+		}
+		keys = append(keys, jwks...)
+	}
+
+	if p.JwksFile != "" {
+		contents, err := os.ReadFile(p.JwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+
+		jwks, err := parseJWKS(contents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS file %s: %w", p.JwksFile, err)
+		}
+		keys = append(keys, jwks...)
+	}
+
+	for i, key := range p.PublicKeys {
+		jwks, err := parsePublicKeys([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %d: %w", i, err)
+		}
+		keys = append(keys, jwks...)
+	}
+
+	for _, file := range p.PublicKeyFiles {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key file: %w", err)
+		}
+
+		jwks, err := parsePublicKeys(contents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key file %s: %w", file, err)
+		}
+		keys = append(keys, jwks...)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	return keys, nil
+}
+
+func parseJWKS(data []byte) ([]jwkset.JWK, error) {
+	var jwks jwkset.JWKSMarshal
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwks.JWKSlice()
+}
+
+// parsePublicKeys reads every PEM encoded public key or certificate in data
+func parsePublicKeys(data []byte) ([]jwkset.JWK, error) {
+	var keys []jwkset.JWK
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := parsePublicKey(block)
+		if err != nil {
+			return nil, err
+		}
+
+		jwk, err := jwkset.NewJWKFromKey(key, jwkset.JWKOptions{})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwk)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+
+	return keys, nil
+}
+
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q, expected a public key or a certificate", block.Type)
+	}
+}
+
+// Verifies tokens with the keys supplied by a policy.
+// PEM keys have no kid, so a token whose kid is not in the set is checked against every key without a kid.
+type staticKeyfunc struct {
+	keys keyfunc.Keyfunc
+}
+
+var _ keyfunc.Keyfunc = staticKeyfunc{}
+
+func (k staticKeyfunc) Keyfunc(token *jwt.Token) (any, error) {
+	return k.KeyfuncCtx(context.Background())(token)
+}
+
+func (k staticKeyfunc) KeyfuncCtx(ctx context.Context) jwt.Keyfunc {
+	byKid := k.keys.KeyfuncCtx(ctx)
+	return func(token *jwt.Token) (any, error) {
+		key, err := byKid(token)
+		if err == nil || !errors.Is(err, jwkset.ErrKeyNotFound) {
+			return key, err
+		}
+
+		withoutKid, readErr := k.keysWithoutKid(ctx)
+		if readErr != nil || len(withoutKid.Keys) == 0 {
+			return nil, err
+		}
+
+		return withoutKid, nil
+	}
+}
+
+func (k staticKeyfunc) Storage() jwkset.Storage {
+	return k.keys.Storage()
+}
+
+func (k staticKeyfunc) VerificationKeySet(ctx context.Context) (jwt.VerificationKeySet, error) {
+	return k.keys.VerificationKeySet(ctx)
+}
+
+func (k staticKeyfunc) keysWithoutKid(ctx context.Context) (jwt.VerificationKeySet, error) {
+	jwks, err := k.keys.Storage().KeyReadAll(ctx)
+	if err != nil {
+		return jwt.VerificationKeySet{}, err
+	}
+
+	var set jwt.VerificationKeySet
+	for _, jwk := range jwks {
+		if jwk.Marshal().KID != "" {
+			continue
+		}
+
+		key := jwk.Key()
+		if private, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+			key = private.Public()
+		}
+		set.Keys = append(set.Keys, key)
+	}
+
+	return set, nil
+}
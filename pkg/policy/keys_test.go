@@ -0,0 +1,221 @@
+package policy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadStaticKeys(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	key := generateRSAKey(t)
+	otherKey := generateRSAKey(t)
+
+	cases := map[string]struct {
+		policy func(dir string) Policy
+		// the kid in the header of the presented token
+		kid     string
+		signer  *rsa.PrivateKey
+		err     string
+		loadErr string
+	}{
+		"inline jwks": {
+			policy: func(string) Policy {
+				return Policy{JwksInline: string(publicJWKS(t, key, "key-1"))}
+			},
+			kid:    "key-1",
+			signer: key,
+		},
+		"inline jwks with unknown kid": {
+			policy: func(string) Policy {
+				return Policy{JwksInline: string(publicJWKS(t, key, "key-1"))}
+			},
+			kid:    "key-2",
+			signer: key,
+			err:    "key not found",
+		},
+		"jwks file": {
+			policy: func(dir string) Policy {
+				writeFile(t, dir, "jwks.json", publicJWKS(t, key, "key-1"))
+				return Policy{JwksFile: filepath.Join(dir, "jwks.json")}
+			},
+			kid:    "key-1",
+			signer: key,
+		},
+		"inline pem key with any kid": {
+			policy: func(string) Policy {
+				return Policy{PublicKeys: StringList{string(publicPEM(t, key))}}
+			},
+			kid:    "whatever",
+			signer: key,
+		},
+		"inline pem key rejects other signer": {
+			policy: func(string) Policy {
+				return Policy{PublicKeys: StringList{string(publicPEM(t, key))}}
+			},
+			kid:    "whatever",
+			signer: otherKey,
+			err:    "token signature is invalid",
+		},
+		"pem key file with several keys": {
+			policy: func(dir string) Policy {
+				writeFile(t, dir, "keys.pem", append(publicPEM(t, otherKey), publicPEM(t, key)...))
+				return Policy{PublicKeyFiles: StringList{filepath.Join(dir, "keys.pem")}}
+			},
+			kid:    "whatever",
+			signer: key,
+		},
+		"missing key file": {
+			policy: func(dir string) Policy {
+				return Policy{PublicKeyFiles: StringList{filepath.Join(dir, "missing.pem")}}
+			},
+			loadErr: "failed to read public key file",
+		},
+		"private key is not accepted": {
+			policy: func(string) Policy {
+				block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+				return Policy{PublicKeys: StringList{string(pem.EncodeToMemory(block))}}
+			},
+			loadErr: "unsupported PEM block",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := tc.policy(t.TempDir())
+			err := p.LoadJwks(t.Context(), logger)
+			if tc.loadErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.loadErr)
+				return
+			}
+			require.NoError(t, err)
+
+			token, err := jwks.GenerateToken(tc.signer, "issuer", "subject", tc.kid)
+			require.NoError(t, err)
+
+			_, err = jwt.Parse(token, p.Jwks.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestStaticKeyFilesRefresh(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	key := generateRSAKey(t)
+	rotatedKey := generateRSAKey(t)
+
+	dir := t.TempDir()
+	writeFile(t, dir, "jwks.json", publicJWKS(t, key, "key-1"))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	p := Policy{
+		JwksFile:           filepath.Join(dir, "jwks.json"),
+		KeyRefreshInterval: Duration(10 * time.Millisecond),
+	}
+	err := p.LoadJwks(ctx, logger)
+	require.NoError(t, err)
+
+	verify := func(signer *rsa.PrivateKey, kid string) error {
+		token, err := jwks.GenerateToken(signer, "issuer", "subject", kid)
+		require.NoError(t, err)
+		_, err = jwt.Parse(token, p.Jwks.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+		return err
+	}
+
+	require.NoError(t, verify(key, "key-1"))
+	require.Error(t, verify(rotatedKey, "key-2"))
+
+	// a file that fails to parse keeps the previous keys
+	writeFile(t, dir, "jwks.json", []byte("not json"))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, verify(key, "key-1"))
+
+	writeFile(t, dir, "jwks.json", publicJWKS(t, rotatedKey, "key-2"))
+	assert.Eventually(t, func() bool {
+		return verify(rotatedKey, "key-2") == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Error(t, verify(key, "key-1"))
+}
+
+func TestReadResolvesKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "policy.toml", []byte(`
+issuer = "cluster.local"
+algorithm = "RS256"
+jwks_file = "keys/jwks.json"
+public_key_files = ["/etc/keys/key.pem"]
+key_refresh_interval = "1m"
+allowed_scopes = ["devices:read"]
+`))
+
+	policies, err := ReadFromDir(dir, ReadOptions{})
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+
+	assert.Equal(t, filepath.Join(dir, "keys", "jwks.json"), policies[0].JwksFile)
+	assert.Equal(t, StringList{"/etc/keys/key.pem"}, policies[0].PublicKeyFiles)
+	assert.Equal(t, Duration(time.Minute), policies[0].KeyRefreshInterval)
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return key
+}
+
+func publicJWKS(t *testing.T, key *rsa.PrivateKey, kid string) []byte {
+	t.Helper()
+
+	jwk, err := jwkset.NewJWKFromKey(&key.PublicKey, jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: kid, ALG: jwkset.AlgRS256}})
+	require.NoError(t, err)
+
+	storage := jwkset.NewMemoryStorage()
+	require.NoError(t, storage.KeyWrite(t.Context(), jwk))
+
+	raw, err := storage.JSONPublic(t.Context())
+	require.NoError(t, err)
+
+	return raw
+}
+
+func publicPEM(t *testing.T, key *rsa.PrivateKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func writeFile(t *testing.T, dir, name string, contents []byte) {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, contents, 0o644))
+}
@@ -0,0 +1,280 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+type MatchKind string
+
+const (
+	MatchExact MatchKind = "exact"
+	MatchGlob  MatchKind = "glob"
+	MatchRegex MatchKind = "regex"
+	MatchOneOf MatchKind = "one_of"
+)
+
+var ErrClaimMismatch = errors.New("claim mismatch")
+
+// Matches the value of a single claim.
+// In TOML a matcher is written as a string (exact), a list of strings (one of),
+// or a table with exactly one of the exact, glob, regex or one_of keys.
+type ClaimMatcher struct {
+	Kind   MatchKind
+	Values []string
+
+	// compiled form of a glob or regex matcher, set when the policy is compiled
+	pattern *regexp.Regexp
+}
+
+var _ unstable.Unmarshaler = (*ClaimMatcher)(nil)
+
+func (m *ClaimMatcher) UnmarshalTOML(data []byte) error {
+	value, err := decodeRaw(data)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		*m = ClaimMatcher{Kind: MatchExact, Values: []string{v}}
+		return nil
+	case []any:
+		values, err := toStrings(v)
+		if err != nil {
+			return err
+		}
+		*m = ClaimMatcher{Kind: MatchOneOf, Values: values}
+		return nil
+	case map[string]any:
+		if len(v) != 1 {
+			return errors.New("a claim matcher table must have exactly one of exact, glob, regex or one_of")
+		}
+
+		for key, inner := range v {
+			kind := MatchKind(key)
+			switch kind {
+			case MatchExact, MatchGlob, MatchRegex:
+				str, ok := inner.(string)
+				if !ok {
+					return fmt.Errorf("%s must be a string, found %T", key, inner)
+				}
+				*m = ClaimMatcher{Kind: kind, Values: []string{str}}
+			case MatchOneOf:
+				list, ok := inner.([]any)
+				if !ok {
+					return fmt.Errorf("%s must be a list of strings, found %T", key, inner)
+				}
+				values, err := toStrings(list)
+				if err != nil {
+					return err
+				}
+				*m = ClaimMatcher{Kind: kind, Values: values}
+			default:
+				return fmt.Errorf("unknown claim matcher %q", key)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("expected a string, a list of strings or a table, found %T", value)
+	}
+}
+
+func (m *ClaimMatcher) compile() error {
+	switch m.Kind {
+	case MatchExact, MatchOneOf:
+		if len(m.Values) == 0 {
+			return fmt.Errorf("%s matcher has no values", m.Kind)
+		}
+		return nil
+	case MatchGlob, MatchRegex:
+		if len(m.Values) != 1 {
+			return fmt.Errorf("%s matcher must have exactly one pattern", m.Kind)
+		}
+		pattern, err := compilePattern(m.Kind, m.Values[0])
+		if err != nil {
+			return err
+		}
+		m.pattern = pattern
+		return nil
+	default:
+		return fmt.Errorf("unknown claim matcher %q", m.Kind)
+	}
+}
+
+// Reports whether the claim value satisfies the matcher.
+// Claims holding a list match if any of their elements match. A glob or regex matcher that has not been compiled never matches.
+func (m ClaimMatcher) Match(value any) bool {
+	if list, ok := value.([]any); ok {
+		return slices.ContainsFunc(list, m.Match)
+	}
+
+	if value == nil {
+		return false
+	}
+
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case float64:
+		// JSON numbers are decoded as floats, which are written without an exponent so that e.g. 1234567 matches "1234567"
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool, int, int64:
+		str = fmt.Sprint(v)
+	default:
+		return false
+	}
+
+	switch m.Kind {
+	case MatchExact, MatchOneOf:
+		return slices.Contains(m.Values, str)
+	case MatchGlob, MatchRegex:
+		return m.pattern != nil && m.pattern.MatchString(str)
+	default:
+		return false
+	}
+}
+
+// A glob or anchored regex pattern.
+// In TOML a pattern is written as a string (glob), or a table with exactly one of the glob or regex keys.
+type Pattern struct {
+	Kind  MatchKind
+	Value string
+
+	// compiled form of the pattern, set when the policy is compiled
+	re *regexp.Regexp
+}
+
+var _ unstable.Unmarshaler = (*Pattern)(nil)
+
+func (p *Pattern) UnmarshalTOML(data []byte) error {
+	value, err := decodeRaw(data)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		*p = Pattern{Kind: MatchGlob, Value: v}
+		return nil
+	case map[string]any:
+		if len(v) != 1 {
+			return errors.New("a pattern table must have exactly one of glob or regex")
+		}
+
+		for key, inner := range v {
+			kind := MatchKind(key)
+			if kind != MatchGlob && kind != MatchRegex {
+				return fmt.Errorf("unknown pattern kind %q", key)
+			}
+
+			str, ok := inner.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a string, found %T", key, inner)
+			}
+			*p = Pattern{Kind: kind, Value: str}
+		}
+		return nil
+	default:
+		return fmt.Errorf("expected a string or a table, found %T", value)
+	}
+}
+
+func (p *Pattern) compile() error {
+	re, err := compilePattern(p.Kind, p.Value)
+	if err != nil {
+		return err
+	}
+
+	p.re = re
+	return nil
+}
+
+// Reports whether the value matches the pattern. A pattern that has not been compiled never matches.
+func (p Pattern) Match(value string) bool {
+	return p.re != nil && p.re.MatchString(value)
+}
+
+// Looks up a claim by name. Nested claims are reached with a dotted path, e.g. "extra.environment".
+// A top-level claim whose name contains dots takes precedence over a nested lookup.
+func lookupClaim(claims map[string]any, path string) (any, bool) {
+	if value, ok := claims[path]; ok {
+		return value, true
+	}
+
+	var current any = claims
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = object[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func compilePattern(kind MatchKind, pattern string) (*regexp.Regexp, error) {
+	switch kind {
+	case MatchGlob:
+		return regexp.Compile(globToRegex(pattern))
+	case MatchRegex:
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+		}
+		return re, nil
+	default:
+		return nil, fmt.Errorf("%s is not a pattern matcher", kind)
+	}
+}
+
+// globToRegex translates a glob into an anchored regular expression.
+// '*' matches any run of characters except '/', '**' matches any run of characters
+// and '?' matches a single character except '/'.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
+
+func toStrings(list []any) ([]string, error) {
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of strings, found %T", item)
+		}
+		values = append(values, str)
+	}
+
+	return values, nil
+}
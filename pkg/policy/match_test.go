@@ -0,0 +1,241 @@
+package policy
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimMatcherUnmarshal(t *testing.T) {
+	cases := map[string]struct {
+		toml     string
+		expected ClaimMatcher
+		err      string
+	}{
+		"string is an exact match": {
+			toml:     `claim = "acme/app"`,
+			expected: ClaimMatcher{Kind: MatchExact, Values: []string{"acme/app"}},
+		},
+		"list is a one of match": {
+			toml:     `claim = ["staging", "production"]`,
+			expected: ClaimMatcher{Kind: MatchOneOf, Values: []string{"staging", "production"}},
+		},
+		"inline glob table": {
+			toml:     `claim = { glob = "refs/heads/*" }`,
+			expected: ClaimMatcher{Kind: MatchGlob, Values: []string{"refs/heads/*"}},
+		},
+		"inline regex table": {
+			toml:     `claim = { regex = "v[0-9]+" }`,
+			expected: ClaimMatcher{Kind: MatchRegex, Values: []string{"v[0-9]+"}},
+		},
+		"standard one_of table": {
+			toml:     "[claim]\none_of = [\"a\", \"b\"]",
+			expected: ClaimMatcher{Kind: MatchOneOf, Values: []string{"a", "b"}},
+		},
+		"unknown matcher": {
+			toml: `claim = { prefix = "refs/" }`,
+			err:  "unknown claim matcher",
+		},
+		"more than one matcher": {
+			toml: `claim = { exact = "a", glob = "b*" }`,
+			err:  "exactly one of",
+		},
+		"wrong value type": {
+			toml: `claim = 42`,
+			err:  "expected a string, a list of strings or a table",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var doc struct {
+				Claim ClaimMatcher `toml:"claim"`
+			}
+			err := toml.NewDecoder(strings.NewReader(tc.toml)).EnableUnmarshalerInterface().Decode(&doc)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, doc.Claim)
+		})
+	}
+}
+
+func TestClaimMatcherMatch(t *testing.T) {
+	cases := map[string]struct {
+		matcher ClaimMatcher
+		value   any
+		matches bool
+	}{
+		"exact match": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"acme/app"}},
+			value:   "acme/app",
+			matches: true,
+		},
+		"exact mismatch": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"acme/app"}},
+			value:   "acme/app2",
+			matches: false,
+		},
+		"one of match": {
+			matcher: ClaimMatcher{Kind: MatchOneOf, Values: []string{"staging", "production"}},
+			value:   "production",
+			matches: true,
+		},
+		"one of mismatch": {
+			matcher: ClaimMatcher{Kind: MatchOneOf, Values: []string{"staging", "production"}},
+			value:   "dev",
+			matches: false,
+		},
+		"glob match": {
+			matcher: ClaimMatcher{Kind: MatchGlob, Values: []string{"refs/heads/*"}},
+			value:   "refs/heads/main",
+			matches: true,
+		},
+		"glob star does not cross slashes": {
+			matcher: ClaimMatcher{Kind: MatchGlob, Values: []string{"refs/heads/*"}},
+			value:   "refs/heads/feature/x",
+			matches: false,
+		},
+		"glob double star crosses slashes": {
+			matcher: ClaimMatcher{Kind: MatchGlob, Values: []string{"refs/heads/**"}},
+			value:   "refs/heads/feature/x",
+			matches: true,
+		},
+		"glob treats regex metacharacters literally": {
+			matcher: ClaimMatcher{Kind: MatchGlob, Values: []string{"v1.0"}},
+			value:   "v1x0",
+			matches: false,
+		},
+		"regex is anchored": {
+			matcher: ClaimMatcher{Kind: MatchRegex, Values: []string{"main|develop"}},
+			value:   "not-main",
+			matches: false,
+		},
+		"regex match": {
+			matcher: ClaimMatcher{Kind: MatchRegex, Values: []string{"main|develop"}},
+			value:   "develop",
+			matches: true,
+		},
+		"invalid regex never matches": {
+			matcher: ClaimMatcher{Kind: MatchRegex, Values: []string{"("}},
+			value:   "(",
+			matches: false,
+		},
+		"numbers are matched by their string form": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"2"}},
+			value:   float64(2),
+			matches: true,
+		},
+		"large numbers are matched without an exponent": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"1234567"}},
+			value:   float64(1234567),
+			matches: true,
+		},
+		"large numbers match globs": {
+			matcher: ClaimMatcher{Kind: MatchGlob, Values: []string{"98765*"}},
+			value:   float64(9876543210),
+			matches: true,
+		},
+		"fractional numbers": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"1.5"}},
+			value:   float64(1.5),
+			matches: true,
+		},
+		"booleans are matched by their string form": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"true"}},
+			value:   true,
+			matches: true,
+		},
+		"list claims match if any element matches": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"admins"}},
+			value:   []any{"users", "admins"},
+			matches: true,
+		},
+		"objects never match": {
+			matcher: ClaimMatcher{Kind: MatchExact, Values: []string{"x"}},
+			value:   map[string]any{"x": "x"},
+			matches: false,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			// an invalid pattern is left uncompiled
+			_ = tc.matcher.compile()
+
+			if got, want := tc.matcher.Match(tc.value), tc.matches; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMatchClaims(t *testing.T) {
+	p := Policy{
+		Claims: map[string]ClaimMatcher{
+			"repository":  {Kind: MatchExact, Values: []string{"acme/app"}},
+			"ref":         {Kind: MatchGlob, Values: []string{"refs/heads/*"}},
+			"extra.team":  {Kind: MatchOneOf, Values: []string{"platform", "sre"}},
+			"https://x.y": {Kind: MatchExact, Values: []string{"z"}},
+		},
+	}
+	require.NoError(t, p.Compile())
+
+	claims := map[string]any{
+		"repository":  "acme/app",
+		"ref":         "refs/heads/main",
+		"extra":       map[string]any{"team": "sre"},
+		"https://x.y": "z",
+	}
+
+	cases := map[string]struct {
+		modify func(claims map[string]any)
+		err    string
+	}{
+		"all claims match": {
+			modify: func(claims map[string]any) {},
+		},
+		"unrelated claims are ignored": {
+			modify: func(claims map[string]any) { claims["actor"] = "octocat" },
+		},
+		"mismatched claim": {
+			modify: func(claims map[string]any) { claims["ref"] = "refs/tags/v1" },
+			err:    "claim mismatch: ref",
+		},
+		"missing claim": {
+			modify: func(claims map[string]any) { delete(claims, "repository") },
+			err:    "claim mismatch: repository is missing",
+		},
+		"mismatched nested claim": {
+			modify: func(claims map[string]any) { claims["extra"] = map[string]any{"team": "web"} },
+			err:    "claim mismatch: extra.team",
+		},
+		"missing nested claim": {
+			modify: func(claims map[string]any) { claims["extra"] = "sre" },
+			err:    "claim mismatch: extra.team is missing",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := maps.Clone(claims)
+			tc.modify(c)
+
+			err := p.MatchClaims(c)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrClaimMismatch)
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
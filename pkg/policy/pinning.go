@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrKeyNotPinned = errors.New("key not pinned by policy")
+
+// Whether the policy trusts only some of the keys of its issuer
+func (p Policy) pinsKeys() bool {
+	return len(p.AllowedKids) > 0 || len(p.AllowedKeyThumbprints) > 0
+}
+
+// Keyfunc resolves the key a token is verified with from the policy's keys.
+// If the policy pins keys by kid or thumbprint, tokens signed by any other key of the issuer are refused.
+func (p Policy) Keyfunc(token *jwt.Token) (any, error) {
+	key, err := p.Jwks.Keyfunc(token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.checkAdvertised(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.pinsKeys() {
+		return key, nil
+	}
+
+	pinned, err := p.pinnedKeys(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens without a kid are checked against a set of keys
+	if set, ok := key.(jwt.VerificationKeySet); ok {
+		var allowed jwt.VerificationKeySet
+		for _, candidate := range set.Keys {
+			if containsKey(pinned, candidate) {
+				allowed.Keys = append(allowed.Keys, candidate)
+			}
+		}
+
+		if len(allowed.Keys) == 0 {
+			return nil, ErrKeyNotPinned
+		}
+
+		return allowed, nil
+	}
+
+	if !containsKey(pinned, key) {
+		return nil, ErrKeyNotPinned
+	}
+
+	return key, nil
+}
+
+// pinnedKeys returns the public keys of the policy's key set that are pinned by kid or thumbprint
+func (p Policy) pinnedKeys(ctx context.Context) ([]crypto.PublicKey, error) {
+	jwks, err := p.Jwks.Storage().KeyReadAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+
+	var pinned []crypto.PublicKey
+	for _, jwk := range jwks {
+		allowed := slices.Contains(p.AllowedKids, jwk.Marshal().KID)
+		if !allowed && len(p.AllowedKeyThumbprints) > 0 {
+			thumbprint, err := keyThumbprint(jwk.Marshal())
+			if err == nil && slices.Contains(p.AllowedKeyThumbprints, thumbprint) {
+				allowed = true
+			}
+		}
+
+		if !allowed {
+			continue
+		}
+
+		key := jwk.Key()
+		if private, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+			key = private.Public()
+		}
+		pinned = append(pinned, key)
+	}
+
+	return pinned, nil
+}
+
+func containsKey(keys []crypto.PublicKey, key any) bool {
+	equal, ok := key.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+
+	return slices.ContainsFunc(keys, equal.Equal)
+}
+
+// keyThumbprint computes the RFC 7638 thumbprint of a JWK: the unpadded base64url SHA-256 of its required members,
+// serialized without whitespace and in lexicographic order
+func keyThumbprint(jwk jwkset.JWKMarshal) (string, error) {
+	var members map[string]string
+	switch jwk.KTY {
+	case jwkset.KtyRSA:
+		members = map[string]string{"e": jwk.E, "kty": jwk.KTY.String(), "n": jwk.N}
+	case jwkset.KtyEC:
+		members = map[string]string{"crv": jwk.CRV.String(), "kty": jwk.KTY.String(), "x": jwk.X, "y": jwk.Y}
+	case jwkset.KtyOKP:
+		members = map[string]string{"crv": jwk.CRV.String(), "kty": jwk.KTY.String(), "x": jwk.X}
+	default:
+		return "", fmt.Errorf("no thumbprint for key type %q", jwk.KTY)
+	}
+
+	// maps are marshaled with their keys sorted
+	raw, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"crypto/rsa"
+	"testing"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyThumbprint(t *testing.T) {
+	// the example of RFC 7638, section 3.1
+	jwk := jwkset.JWKMarshal{
+		KTY: jwkset.KtyRSA,
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		ALG: jwkset.AlgRS256,
+		KID: "2011-04-29",
+	}
+
+	thumbprint, err := keyThumbprint(jwk)
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+}
+
+func TestPinnedKeys(t *testing.T) {
+	ourKey := generateRSAKey(t)
+	otherTenantKey := generateRSAKey(t)
+	kf := keyfuncFromJWKS(t, map[string]*rsa.PrivateKey{"ours": ourKey, "other-tenant": otherTenantKey})
+
+	jwks, err := kf.Storage().KeyReadAll(t.Context())
+	require.NoError(t, err)
+
+	var ourThumbprint string
+	for _, jwk := range jwks {
+		if jwk.Marshal().KID == "ours" {
+			ourThumbprint, err = keyThumbprint(jwk.Marshal())
+			require.NoError(t, err)
+		}
+	}
+
+	cases := map[string]struct {
+		policy Policy
+		signer *rsa.PrivateKey
+		// the kid in the token header, none if empty
+		kid string
+		err error
+	}{
+		"no pinning trusts every key": {
+			policy: Policy{},
+			signer: otherTenantKey,
+			kid:    "other-tenant",
+		},
+		"pinned kid": {
+			policy: Policy{AllowedKids: StringList{"ours"}},
+			signer: ourKey,
+			kid:    "ours",
+		},
+		"key not pinned by kid": {
+			policy: Policy{AllowedKids: StringList{"ours"}},
+			signer: otherTenantKey,
+			kid:    "other-tenant",
+			err:    ErrKeyNotPinned,
+		},
+		"pinned thumbprint": {
+			policy: Policy{AllowedKeyThumbprints: StringList{ourThumbprint}},
+			signer: ourKey,
+			kid:    "ours",
+		},
+		"key not pinned by thumbprint": {
+			policy: Policy{AllowedKeyThumbprints: StringList{ourThumbprint}},
+			signer: otherTenantKey,
+			kid:    "other-tenant",
+			err:    ErrKeyNotPinned,
+		},
+		"token without kid signed by a pinned key": {
+			policy: Policy{AllowedKids: StringList{"ours"}},
+			signer: ourKey,
+		},
+		"token without kid signed by a key that is not pinned": {
+			policy: Policy{AllowedKids: StringList{"ours"}},
+			signer: otherTenantKey,
+			err:    jwt.ErrTokenSignatureInvalid,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := tc.policy
+			p.Jwks = kf
+
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": "issuer"})
+			if tc.kid != "" {
+				token.Header["kid"] = tc.kid
+			}
+			signed, err := token.SignedString(tc.signer)
+			require.NoError(t, err)
+
+			_, err = jwt.Parse(signed, p.Keyfunc, jwt.WithValidMethods([]string{"RS256"}))
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidatePinnedKeys(t *testing.T) {
+	assert.NoError(t, validatePinnedKeys([]string{"key-1"}, []string{"NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"}))
+	assert.ErrorContains(t, validatePinnedKeys([]string{""}, nil), "empty kid")
+	assert.ErrorContains(t, validatePinnedKeys(nil, []string{"not-a-thumbprint"}), "invalid key thumbprint")
+}
+
+// keyfuncFromJWKS builds a Keyfunc over the public keys, keyed by kid
+func keyfuncFromJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) keyfunc.Keyfunc {
+	t.Helper()
+
+	storage := jwkset.NewMemoryStorage()
+	for kid, key := range keys {
+		jwk, err := jwkset.NewJWKFromKey(&key.PublicKey, jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: kid, ALG: jwkset.AlgRS256}})
+		require.NoError(t, err)
+		require.NoError(t, storage.KeyWrite(t.Context(), jwk))
+	}
+
+	kf, err := keyfunc.New(keyfunc.Options{Ctx: t.Context(), Storage: storage})
+	require.NoError(t, err)
+
+	return kf
+}
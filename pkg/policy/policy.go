@@ -4,24 +4,138 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"slices"
 
 	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/cel-go/cel"
 )
 
 type Policy struct {
-	Issuer        string  `toml:"issuer"`
-	Algorithm     string  `toml:"algorithm"`
-	Subject       *string `toml:"subject"`
-	JwksURL       string  `toml:"jwks_url"`
-	Jwks          keyfunc.Keyfunc
+	Name   string `toml:"name"`
+	Issuer string `toml:"issuer"`
+	// the key is singular so that policies written before several algorithms were supported keep working
+	Algorithms     StringList              `toml:"algorithm"`
+	Subject        *string                 `toml:"subject"`
+	SubjectPattern *Pattern                `toml:"subject_pattern"`
+	Audience       StringList              `toml:"audience"`
+	Claims         map[string]ClaimMatcher `toml:"claims"`
+	Condition      string                  `toml:"condition"`
+	JwksURL        string                  `toml:"jwks_url"`
+	// keys supplied by the policy itself, for issuers without a reachable JWKS endpoint
+	JwksInline         string     `toml:"jwks_inline"`
+	JwksFile           string     `toml:"jwks_file"`
+	PublicKeys         StringList `toml:"public_keys"`
+	PublicKeyFiles     StringList `toml:"public_key_files"`
+	KeyRefreshInterval Duration   `toml:"key_refresh_interval"`
+	// pin the keys of the issuer the policy trusts, by kid or by RFC 7638 thumbprint
+	AllowedKids           StringList      `toml:"allowed_kids"`
+	AllowedKeyThumbprints StringList      `toml:"allowed_key_thumbprints"`
+	Jwks                  keyfunc.Keyfunc `toml:"-"`
+	// limits on when a token is valid. exp is required unless require_exp is false
+	RequireExp       *bool    `toml:"require_exp"`
+	RequireIat       bool     `toml:"require_iat"`
+	MaxTokenAge      Duration `toml:"max_token_age"`
+	MaxTokenLifetime Duration `toml:"max_token_lifetime"`
+	Leeway           Duration `toml:"leeway"`
+	// accept each token at most once, by remembering its jti until it expires
+	SingleUse bool `toml:"single_use"`
+	// limits on the Tailscale auth keys the policy allows. Auth keys are only issued by policies that set allowed_tags
+	AllowedTags            StringList `toml:"allowed_tags"`
+	MaxKeyExpiry           Duration   `toml:"max_key_expiry"`
+	AllowReusableKeys      bool       `toml:"allow_reusable_keys"`
+	AllowNonEphemeralKeys  bool       `toml:"allow_non_ephemeral_keys"`
+	AllowPreauthorizedKeys bool       `toml:"allow_preauthorized_keys"`
+	// the named Tailscale credentials that access tokens are fetched with. Empty for the default credentials
+	Backend       string   `toml:"backend"`
 	AllowedScopes []string `toml:"allowed_scopes"`
+	Effect        Effect   `toml:"effect"`
+	DeniedScopes  []string `toml:"denied_scopes"`
+
+	// compiled form of Condition, set when the policy is compiled
+	condition cel.Program
+}
+
+// Everything a policy's conditions are evaluated against
+type Input struct {
+	// claims of a token whose signature has been verified
+	Claims  jwt.MapClaims
+	Scopes  []string
+	Request RequestMetadata
+	// the auth key being requested, if any
+	Key *KeyRequest
 }
 
 type PolicyList []Policy
 
-func (p *Policy) LoadJwks(ctx context.Context) error {
-	jwks, err := keyfunc.NewDefaultCtx(ctx, []string{p.JwksURL})
+// Whether a policy grants or denies the scopes it lists
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Denies every scope when listed in denied_scopes
+const AnyScope = "*"
+
+var (
+	ErrMissingAudience  = errors.New("missing audience")
+	ErrAudienceMismatch = errors.New("audience mismatch")
+	ErrSubjectMismatch  = errors.New("subject mismatch")
+	ErrDenied           = errors.New("denied by policy")
+)
+
+// Loads the policy's JWKS. Keys supplied by the policy itself are used as-is.
+// Otherwise, without a jwks_url, the JWKS URL is resolved through the issuer's OpenID discovery document.
+func (p *Policy) LoadJwks(ctx context.Context, logger *slog.Logger) error {
+	if p.hasStaticKeys() {
+		jwks, err := p.loadStaticKeys(ctx, logger)
+		if err != nil {
+			return fmt.Errorf("failed to load static keys: %w", err)
+		}
+		p.Jwks = jwks
+
+		return nil
+	}
+
+	keys := &remoteKeys{}
+	if p.JwksURL == "" {
+		jwksURL, advertised, err := p.discoverJwksURL(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to discover JWKS URL: %w", err)
+		}
+		p.JwksURL = jwksURL
+
+		// a document that advertises no algorithms does not restrict them
+		if len(advertised) == 0 {
+			logger.Warn("Issuer does not advertise its signing algorithms, accepting every algorithm the policy allows", "policy", p.Name)
+		} else {
+			keys.algorithms = advertised
+
+			// a policy that allows algorithms its issuer does not use is a configuration error, retrying does not fix it
+			if missing := p.unadvertisedAlgorithms(advertised); len(missing) > 0 {
+				logger.Error("Issuer does not advertise algorithms the policy allows, tokens signed with them are refused",
+					"policy", p.Name, "algorithms", missing, "advertised", advertised)
+			}
+		}
+	}
+
+	// fail when the JWKS cannot be fetched, rather than starting with no keys, so the policy's keys are retried until they load
+	noKeysIsError := false
+	jwks, err := keyfunc.NewDefaultOverrideCtx(ctx, []string{p.JwksURL}, keyfunc.Override{
+		HTTPTimeout:               jwksTimeout,
+		RefreshInterval:           jwksRefreshInterval,
+		NoErrorReturnFirstHTTPReq: &noKeysIsError,
+		RefreshErrorHandlerFunc: func(u string) func(ctx context.Context, err error) {
+			return func(ctx context.Context, err error) {
+				keys.refreshFailed.Store(true)
+				logger.Error("Failed to refresh JWKS, keeping the previous keys", "policy", p.Name, "url", u, "error", err)
+			}
+		},
+	})
 	if err != nil {
 		return fmt.Errorf("failed to get JWKS: %w", err)
 	}
@@ -30,13 +144,14 @@ func (p *Policy) LoadJwks(ctx context.Context) error {
 		return errors.New("failed to get JWKS")
 	}
 
-	p.Jwks = jwks
+	keys.keys = jwks
+	p.Jwks = keys
 
 	return nil
 }
 
 func (p Policy) Satisfied(requestedScopes []string) bool {
-	if len(requestedScopes) == 0 {
+	if p.IsDeny() || len(requestedScopes) == 0 {
 		return false
 	}
 
@@ -49,35 +164,172 @@ func (p Policy) Satisfied(requestedScopes []string) bool {
 	return true
 }
 
-// TODO: refactor this function to accept a policyReader. add tests.
-func GetPolicies(ctx context.Context, dir string) (PolicyList, error) {
-	policies, err := ReadFromDir(dir)
+// Checks every condition of the policy against the token's claims and the request.
+// The token's signature must be verified before its claims are trusted.
+func (p Policy) Match(in Input) error {
+	audience, err := in.Claims.GetAudience()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read policies from dir %s: %w", dir, err)
+		return err
+	}
+
+	err = p.ValidateAudience(audience)
+	if err != nil {
+		return err
+	}
+
+	subject, err := in.Claims.GetSubject()
+	if err != nil {
+		return err
+	}
+
+	err = p.ValidateSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	err = p.MatchClaims(in.Claims)
+	if err != nil {
+		return err
+	}
+
+	return p.MatchCondition(in)
+}
+
+// Checks the token's audience against the policy. Any audience is accepted if the policy does not specify one.
+func (p Policy) ValidateAudience(audience []string) error {
+	if len(p.Audience) == 0 {
+		return nil
+	}
+
+	if len(audience) == 0 {
+		return ErrMissingAudience
+	}
+
+	for _, aud := range audience {
+		if slices.Contains(p.Audience, aud) {
+			return nil
+		}
+	}
+
+	return ErrAudienceMismatch
+}
+
+// Checks the token's subject against the policy. Any subject is accepted if the policy specifies neither subject nor subject_pattern.
+func (p Policy) ValidateSubject(subject string) error {
+	if p.Subject != nil && subject != *p.Subject {
+		return fmt.Errorf("%w: expected %q", ErrSubjectMismatch, *p.Subject)
+	}
+
+	if p.SubjectPattern != nil && !p.SubjectPattern.Match(subject) {
+		return fmt.Errorf("%w: expected to match %s %q", ErrSubjectMismatch, p.SubjectPattern.Kind, p.SubjectPattern.Value)
+	}
+
+	return nil
+}
+
+// Checks the token's claims against every claim matcher of the policy.
+// Claims that are not mentioned by the policy are ignored.
+func (p Policy) MatchClaims(claims map[string]any) error {
+	// iterate in a stable order so the reported mismatch is deterministic
+	names := slices.Sorted(maps.Keys(p.Claims))
+	for _, name := range names {
+		value, ok := lookupClaim(claims, name)
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrClaimMismatch, name)
+		}
+
+		if !p.Claims[name].Match(value) {
+			return fmt.Errorf("%w: %s", ErrClaimMismatch, name)
+		}
 	}
 
-	var loadJWKSErrors error
-	for i := range policies {
-		policy := &policies[i]
-		err := policy.LoadJwks(ctx)
+	return nil
+}
+
+// Evaluates the policy's condition expression. A policy without a condition always matches.
+// A condition that has not been compiled cannot be evaluated.
+func (p Policy) MatchCondition(in Input) error {
+	if p.Condition == "" {
+		return nil
+	}
+
+	if p.condition == nil {
+		return fmt.Errorf("%w: %w: condition has not been compiled", ErrConditionNotMet, ErrConditionFailed)
+	}
+
+	return evalCondition(p.condition, in)
+}
+
+// Compile prepares the policy's patterns and condition for matching. Policies read from a file are compiled when they are read,
+// policies built in code must be compiled before they are matched.
+// Invalid patterns are left uncompiled and never match, ValidatePolicy reports them.
+func (p *Policy) Compile() error {
+	var result error
+	if p.SubjectPattern != nil {
+		err := p.SubjectPattern.compile()
 		if err != nil {
-			loadJWKSErrors = errors.Join(loadJWKSErrors, fmt.Errorf("failed to load JWKS for policy: %w", err))
+			result = errors.Join(result, fmt.Errorf("invalid subject pattern: %w", err))
 		}
 	}
 
-	if loadJWKSErrors != nil {
-		return nil, loadJWKSErrors
+	for name, matcher := range p.Claims {
+		err := matcher.compile()
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("invalid matcher for claim %s: %w", name, err))
+			continue
+		}
+		p.Claims[name] = matcher
+	}
+
+	if p.Condition != "" {
+		program, err := compileCondition(p.Condition)
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("invalid condition: %w", err))
+		} else {
+			p.condition = program
+		}
 	}
 
-	return policies, nil
+	return result
 }
 
-func (p PolicyList) FindByIssuer(issuer string) *Policy {
+func (p Policy) IsDeny() bool {
+	return p.Effect == EffectDeny
+}
+
+// Returns the requested scopes that the policy denies. Allow policies never deny scopes.
+func (p Policy) Denies(requestedScopes []string) []string {
+	if !p.IsDeny() {
+		return nil
+	}
+
+	if slices.Contains(p.DeniedScopes, AnyScope) {
+		return requestedScopes
+	}
+
+	var denied []string
+	for _, requestedScope := range requestedScopes {
+		if slices.Contains(p.DeniedScopes, requestedScope) {
+			denied = append(denied, requestedScope)
+		}
+	}
+
+	return denied
+}
+
+// Returns the list itself, so a fixed PolicyList can be used wherever the active policies are read from a Store.
+func (p PolicyList) Policies() PolicyList {
+	return p
+}
+
+// Returns every policy that trusts the issuer, in the order they were loaded.
+func (p PolicyList) FilterByIssuer(issuer string) PolicyList {
+	var policies PolicyList
 	for _, policy := range p {
 		if policy.Issuer == issuer {
-			return &policy
+			policies = append(policies, policy)
 		}
 	}
 
-	return nil
+	return policies
 }
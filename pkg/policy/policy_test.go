@@ -1,6 +1,8 @@
 package policy
 
 import (
+	"errors"
+	"slices"
 	"testing"
 )
 
@@ -34,6 +36,11 @@ func TestSatisfied(t *testing.T) {
 			requestedScopes: []string{"users:read", "among:us"},
 			policySatisfied: false,
 		},
+		"deny policies are never satisfied": {
+			policy:          Policy{Effect: EffectDeny, AllowedScopes: []string{"acls"}, DeniedScopes: []string{"acls"}},
+			requestedScopes: []string{"acls"},
+			policySatisfied: false,
+		},
 		"requesting multiple scopes, with one being not allowed by the policy": {
 			policy:          defaultPolicy,
 			requestedScopes: []string{"devices:read", "acls", "users:read"},
@@ -49,3 +56,190 @@ func TestSatisfied(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateAudience(t *testing.T) {
+	cases := map[string]struct {
+		policyAudience StringList
+		tokenAudience  []string
+		err            error
+	}{
+		"policy without audience accepts any audience": {
+			policyAudience: nil,
+			tokenAudience:  []string{"something-else"},
+			err:            nil,
+		},
+		"policy without audience accepts a missing audience": {
+			policyAudience: nil,
+			tokenAudience:  nil,
+			err:            nil,
+		},
+		"matching audience": {
+			policyAudience: StringList{"tailsts"},
+			tokenAudience:  []string{"tailsts"},
+			err:            nil,
+		},
+		"one of several token audiences matches": {
+			policyAudience: StringList{"tailsts"},
+			tokenAudience:  []string{"other", "tailsts"},
+			err:            nil,
+		},
+		"token audience matches one of several policy audiences": {
+			policyAudience: StringList{"tailsts", "https://tailsts.example.com"},
+			tokenAudience:  []string{"https://tailsts.example.com"},
+			err:            nil,
+		},
+		"missing audience": {
+			policyAudience: StringList{"tailsts"},
+			tokenAudience:  nil,
+			err:            ErrMissingAudience,
+		},
+		"mismatched audience": {
+			policyAudience: StringList{"tailsts"},
+			tokenAudience:  []string{"https://github.com/acme"},
+			err:            ErrAudienceMismatch,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			p := Policy{Audience: tc.policyAudience}
+			if got, want := p.ValidateAudience(tc.tokenAudience), tc.err; !errors.Is(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateSubject(t *testing.T) {
+	subject := "repo:acme/app:ref:refs/heads/main"
+
+	cases := map[string]struct {
+		policy       Policy
+		tokenSubject string
+		err          error
+	}{
+		"policy without subject accepts any subject": {
+			policy:       Policy{},
+			tokenSubject: "anything",
+			err:          nil,
+		},
+		"exact subject match": {
+			policy:       Policy{Subject: &subject},
+			tokenSubject: subject,
+			err:          nil,
+		},
+		"exact subject mismatch": {
+			policy:       Policy{Subject: &subject},
+			tokenSubject: "repo:acme/app:ref:refs/heads/dev",
+			err:          ErrSubjectMismatch,
+		},
+		"glob subject match": {
+			policy:       Policy{SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/*:ref:refs/heads/main"}},
+			tokenSubject: "repo:acme/api:ref:refs/heads/main",
+			err:          nil,
+		},
+		"glob subject mismatch": {
+			policy:       Policy{SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/*:ref:refs/heads/main"}},
+			tokenSubject: "repo:evil/api:ref:refs/heads/main",
+			err:          ErrSubjectMismatch,
+		},
+		"regex subject match": {
+			policy:       Policy{SubjectPattern: &Pattern{Kind: MatchRegex, Value: "repo:acme/(app|api):.*"}},
+			tokenSubject: "repo:acme/app:environment:production",
+			err:          nil,
+		},
+		"regex subject is anchored": {
+			policy:       Policy{SubjectPattern: &Pattern{Kind: MatchRegex, Value: "repo:acme/(app|api):.*"}},
+			tokenSubject: "xrepo:acme/app:environment:production",
+			err:          ErrSubjectMismatch,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.policy.Compile(); err != nil {
+				t.Fatalf("failed to compile policy: %v", err)
+			}
+
+			if got, want := tc.policy.ValidateSubject(tc.tokenSubject), tc.err; !errors.Is(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFilterByIssuer(t *testing.T) {
+	policies := PolicyList{
+		{Name: "a", Issuer: "https://token.actions.githubusercontent.com"},
+		{Name: "b", Issuer: "https://gitlab.com"},
+		{Name: "c", Issuer: "https://token.actions.githubusercontent.com"},
+	}
+
+	cases := map[string]struct {
+		issuer        string
+		expectedNames []string
+	}{
+		"every policy for the issuer is returned in order": {
+			issuer:        "https://token.actions.githubusercontent.com",
+			expectedNames: []string{"a", "c"},
+		},
+		"single policy for the issuer": {
+			issuer:        "https://gitlab.com",
+			expectedNames: []string{"b"},
+		},
+		"unknown issuer": {
+			issuer:        "https://example.com",
+			expectedNames: nil,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var names []string
+			for _, p := range policies.FilterByIssuer(tc.issuer) {
+				names = append(names, p.Name)
+			}
+
+			if !slices.Equal(names, tc.expectedNames) {
+				t.Errorf("got %v, want %v", names, tc.expectedNames)
+			}
+		})
+	}
+}
+
+func TestDenies(t *testing.T) {
+	cases := map[string]struct {
+		policy          Policy
+		requestedScopes []string
+		denied          []string
+	}{
+		"allow policies deny nothing": {
+			policy:          Policy{AllowedScopes: []string{"acls"}},
+			requestedScopes: []string{"acls"},
+			denied:          nil,
+		},
+		"denied scope requested": {
+			policy:          Policy{Effect: EffectDeny, DeniedScopes: []string{"acls"}},
+			requestedScopes: []string{"devices:read", "acls"},
+			denied:          []string{"acls"},
+		},
+		"denied scope not requested": {
+			policy:          Policy{Effect: EffectDeny, DeniedScopes: []string{"acls"}},
+			requestedScopes: []string{"devices:read"},
+			denied:          nil,
+		},
+		"wildcard denies every scope": {
+			policy:          Policy{Effect: EffectDeny, DeniedScopes: []string{AnyScope}},
+			requestedScopes: []string{"devices:read", "acls"},
+			denied:          []string{"devices:read", "acls"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got, want := tc.policy.Denies(tc.requestedScopes), tc.denied; !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
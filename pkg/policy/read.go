@@ -3,29 +3,69 @@ package policy
 import (
 	"bytes"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
-func ReadFromDir(dir string) (PolicyList, error) {
-	entries, err := os.ReadDir(dir)
+// Selects the files in a policies directory that are read as policies.
+// Globs without a '/' are matched against a file's name, other globs are matched against its path relative to the directory.
+type ReadOptions struct {
+	// Globs of files to read. Defaults to *.toml when empty.
+	Include []string
+	// Globs of files to skip, even if they are included.
+	Exclude []string
+}
+
+const defaultInclude = "*.toml"
+
+// Reads every included policy file in dir and its subdirectories.
+// Policies are returned in lexical order of their paths.
+func ReadFromDir(dir string, opts ReadOptions) (PolicyList, error) {
+	selector, err := opts.selector()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read directory: %w", err)
+		return nil, err
 	}
 
 	var policies PolicyList
-	for _, entry := range entries {
+	err = filepath.WalkDir(dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+
 		if entry.IsDir() {
-			continue
+			return nil
 		}
 
-		policy, err := readFromFile(dir + "/" + entry.Name())
+		rel, err := filepath.Rel(dir, filename)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read policy: %w", err)
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+		rel = filepath.ToSlash(rel)
+
+		if !selector.selects(rel) {
+			return nil
+		}
+
+		policy, err := readFromFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read policy %s: %w", rel, err)
+		}
+
+		if policy.Name == "" {
+			policy.Name = rel
 		}
 
 		policies = append(policies, policy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	if len(policies) == 0 {
@@ -35,6 +75,74 @@ func ReadFromDir(dir string) (PolicyList, error) {
 	return policies, nil
 }
 
+// The compiled globs of ReadOptions
+type fileSelector struct {
+	include fileGlobs
+	exclude fileGlobs
+}
+
+func (opts ReadOptions) selector() (fileSelector, error) {
+	includeGlobs := opts.Include
+	if len(includeGlobs) == 0 {
+		includeGlobs = []string{defaultInclude}
+	}
+
+	include, err := compileGlobs(includeGlobs)
+	if err != nil {
+		return fileSelector{}, err
+	}
+
+	exclude, err := compileGlobs(opts.Exclude)
+	if err != nil {
+		return fileSelector{}, err
+	}
+
+	return fileSelector{include: include, exclude: exclude}, nil
+}
+
+// selects reports whether the file at the slash-separated relative path is read as a policy
+func (s fileSelector) selects(rel string) bool {
+	return s.include.match(rel) && !s.exclude.match(rel)
+}
+
+type fileGlob struct {
+	re *regexp.Regexp
+	// globs without a '/' are matched against the file name only
+	nameOnly bool
+}
+
+type fileGlobs []fileGlob
+
+func compileGlobs(globs []string) (fileGlobs, error) {
+	compiled := make(fileGlobs, 0, len(globs))
+	for _, glob := range globs {
+		re, err := compilePattern(MatchGlob, glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+
+		compiled = append(compiled, fileGlob{re: re, nameOnly: !strings.Contains(glob, "/")})
+	}
+
+	return compiled, nil
+}
+
+// match reports whether the slash-separated relative path matches any of the globs
+func (g fileGlobs) match(rel string) bool {
+	for _, glob := range g {
+		target := rel
+		if glob.nameOnly {
+			target = path.Base(rel)
+		}
+
+		if glob.re.MatchString(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func readFromFile(filename string) (Policy, error) {
 	contents, err := os.ReadFile(filename)
 	if err != nil {
@@ -42,12 +150,16 @@ func readFromFile(filename string) (Policy, error) {
 	}
 
 	var policy Policy
-	err = toml.NewDecoder(bytes.NewReader(contents)).DisallowUnknownFields().Decode(&policy)
+	err = toml.NewDecoder(bytes.NewReader(contents)).DisallowUnknownFields().EnableUnmarshalerInterface().Decode(&policy)
 	if err != nil {
 		return Policy{}, fmt.Errorf("failed to unmarshal TOML: %w", err)
 	}
 
+	policy.resolveKeyFiles(filepath.Dir(filename))
+
 	// TODO: perform validation here?
+	// compilation errors are surfaced by ValidatePolicy
+	_ = policy.Compile()
 
 	return policy, nil
 }
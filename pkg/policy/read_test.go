@@ -12,28 +12,125 @@ func TestReadFromDir(t *testing.T) {
 	subject := "test"
 
 	policy1 := Policy{
+		Name:          "policy1.toml",
 		Issuer:        "http://localhost:8888",
-		Algorithm:     "RS256",
+		Algorithms:    StringList{"RS256"},
 		JwksURL:       "http://localhost:8888/.well-known/jwks.json",
 		AllowedScopes: []string{"acls", "devices:read"},
 		Subject:       nil,
 	}
 	policy2 := Policy{
+		Name:          "policy2.toml",
 		Issuer:        "http://localhost:8080",
-		Algorithm:     "RS256",
+		Algorithms:    StringList{"RS256"},
 		JwksURL:       "http://localhost:8888/jwks",
 		AllowedScopes: []string{"routes", "logs:read"},
 		Subject:       &subject,
 	}
 	policy3 := Policy{
+		Name:          "policy3.toml",
 		Issuer:        "http://localhost:123",
-		Algorithm:     "RS256",
+		Algorithms:    StringList{"RS256"},
 		JwksURL:       "http://localhost:123/jwks.json",
 		AllowedScopes: []string{"all"},
 	}
+	policy4 := Policy{
+		Name:          "policy1.toml",
+		Issuer:        "http://localhost:8888",
+		Algorithms:    StringList{"RS256"},
+		Audience:      StringList{"tailsts"},
+		JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+		AllowedScopes: []string{"acls", "devices:read"},
+	}
+	policy5 := Policy{
+		Name:          "policy2.toml",
+		Issuer:        "http://localhost:8080",
+		Algorithms:    StringList{"ES256", "RS256"},
+		Audience:      StringList{"tailsts", "https://tailsts.example.com"},
+		JwksURL:       "http://localhost:8080/jwks",
+		AllowedScopes: []string{"routes"},
+	}
+	policy6 := Policy{
+		Name:          "policy1.toml",
+		Issuer:        "https://token.actions.githubusercontent.com",
+		Algorithms:    StringList{"RS256"},
+		JwksURL:       "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes: []string{"devices:read"},
+		Claims: map[string]ClaimMatcher{
+			"repository":  {Kind: MatchExact, Values: []string{"acme/app"}},
+			"ref":         {Kind: MatchGlob, Values: []string{"refs/heads/*"}},
+			"environment": {Kind: MatchOneOf, Values: []string{"staging", "production"}},
+			"workflow":    {Kind: MatchRegex, Values: []string{"deploy-(staging|production)"}},
+			"extra.team":  {Kind: MatchOneOf, Values: []string{"platform", "sre"}},
+		},
+	}
+	policy7 := Policy{
+		Name:           "policy1.toml",
+		Issuer:         "https://token.actions.githubusercontent.com",
+		Algorithms:     StringList{"RS256"},
+		SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/*:ref:refs/heads/main"},
+		JwksURL:        "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes:  []string{"devices:read"},
+	}
+	policy8 := Policy{
+		Name:           "acme-deployments",
+		Issuer:         "https://token.actions.githubusercontent.com",
+		Algorithms:     StringList{"RS256"},
+		SubjectPattern: &Pattern{Kind: MatchRegex, Value: "repo:acme/(app|api):environment:(staging|production)"},
+		JwksURL:        "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes:  []string{"acls"},
+	}
+	policy9 := Policy{
+		Name:          "policy1.toml",
+		Issuer:        "https://token.actions.githubusercontent.com",
+		Algorithms:    StringList{"RS256"},
+		JwksURL:       "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes: []string{"devices:read"},
+		Condition:     `claims.environment != "prod" || claims.ref == "refs/heads/main"`,
+	}
+	policy10 := Policy{
+		Name:         "no-acls-from-forks",
+		Effect:       EffectDeny,
+		Issuer:       "https://token.actions.githubusercontent.com",
+		Algorithms:   StringList{"RS256"},
+		JwksURL:      "https://token.actions.githubusercontent.com/.well-known/jwks",
+		DeniedScopes: []string{"acls"},
+		Claims: map[string]ClaimMatcher{
+			"event_name": {Kind: MatchExact, Values: []string{"pull_request_target"}},
+		},
+	}
+
+	nestedPolicy2 := policy2
+	nestedPolicy2.Name = "more/policy2.toml"
+
+	teamAApp := Policy{
+		Name:           "team-a/app.toml",
+		Issuer:         "https://token.actions.githubusercontent.com",
+		Algorithms:     StringList{"RS256"},
+		SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/app:*"},
+		JwksURL:        "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes:  []string{"devices:read"},
+	}
+	teamBAPI := Policy{
+		Name:           "team-b/api.toml",
+		Issuer:         "https://token.actions.githubusercontent.com",
+		Algorithms:     StringList{"RS256"},
+		SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/api:*"},
+		JwksURL:        "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes:  []string{"acls"},
+	}
+	teamBOld := Policy{
+		Name:           "team-b/archive/old.toml",
+		Issuer:         "https://token.actions.githubusercontent.com",
+		Algorithms:     StringList{"RS256"},
+		SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/old:*"},
+		JwksURL:        "https://token.actions.githubusercontent.com/.well-known/jwks",
+		AllowedScopes:  []string{"all"},
+	}
 
 	cases := map[string]struct {
 		dir              string
+		opts             ReadOptions
 		err              string
 		expectedPolicies PolicyList
 	}{
@@ -58,6 +155,48 @@ func TestReadFromDir(t *testing.T) {
 				policy3,
 			},
 		},
+		"audience and algorithm as a string or a list": {
+			dir: "testdata/audience",
+			err: "",
+			expectedPolicies: PolicyList{
+				policy4,
+				policy5,
+			},
+		},
+		"claim matchers": {
+			dir: "testdata/claims",
+			err: "",
+			expectedPolicies: PolicyList{
+				policy6,
+			},
+		},
+		"invalid claim matcher": {
+			dir:              "testdata/invalid_claims",
+			err:              "unknown claim matcher",
+			expectedPolicies: nil,
+		},
+		"subject patterns": {
+			dir: "testdata/subject_pattern",
+			err: "",
+			expectedPolicies: PolicyList{
+				policy7,
+				policy8,
+			},
+		},
+		"condition": {
+			dir: "testdata/condition",
+			err: "",
+			expectedPolicies: PolicyList{
+				policy9,
+			},
+		},
+		"deny policy": {
+			dir: "testdata/deny",
+			err: "",
+			expectedPolicies: PolicyList{
+				policy10,
+			},
+		},
 		"directory not found": {
 			dir:              "testdata/non_existent",
 			err:              "failed to read directory",
@@ -73,13 +212,51 @@ func TestReadFromDir(t *testing.T) {
 			err:              "failed to read policy",
 			expectedPolicies: nil,
 		},
-		"nested directories, only top-level directory examined": {
+		"nested directories are read recursively": {
 			dir: "testdata/nested",
 			err: "",
 			expectedPolicies: PolicyList{
+				nestedPolicy2,
 				policy1,
 			},
 		},
+		"only toml files are read by default": {
+			dir: "testdata/filtered",
+			err: "",
+			expectedPolicies: PolicyList{
+				teamAApp,
+				teamBAPI,
+				teamBOld,
+			},
+		},
+		"exclude glob matching a path": {
+			dir:  "testdata/filtered",
+			opts: ReadOptions{Exclude: []string{"**/archive/**"}},
+			err:  "",
+			expectedPolicies: PolicyList{
+				teamAApp,
+				teamBAPI,
+			},
+		},
+		"include glob matching a path": {
+			dir:  "testdata/filtered",
+			opts: ReadOptions{Include: []string{"team-b/**.toml"}},
+			err:  "",
+			expectedPolicies: PolicyList{
+				teamBAPI,
+				teamBOld,
+			},
+		},
+		"exclude takes precedence over include": {
+			dir:  "testdata/filtered",
+			opts: ReadOptions{Include: []string{"team-b/*.toml"}, Exclude: []string{"api.toml"}},
+			err:  "no policies found in directory",
+		},
+		"including files that are not policies": {
+			dir:  "testdata/filtered",
+			opts: ReadOptions{Include: []string{"*"}},
+			err:  "failed to read policy",
+		},
 	}
 
 	assert := assert.New(t)
@@ -88,7 +265,7 @@ func TestReadFromDir(t *testing.T) {
 	require.NoError(err)
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			policies, err := ReadFromDir(tc.dir)
+			policies, err := ReadFromDir(tc.dir, tc.opts)
 			if tc.err == "" {
 				assert.NoError(err)
 
@@ -96,7 +273,7 @@ func TestReadFromDir(t *testing.T) {
 				actualPolicyCount := len(policies)
 				assert.Equal(expectedPolicyCount, actualPolicyCount, "expected %d policies, got %d", expectedPolicyCount, actualPolicyCount)
 
-				// os.ReadDir sorts by filename, so we can compare policies in order
+				// filepath.WalkDir walks in lexical order, so we can compare policies in order
 				for i, expectedPolicy := range tc.expectedPolicies {
 					assertPolicyEqual(assert, expectedPolicy, policies[i])
 				}
@@ -109,9 +286,25 @@ func TestReadFromDir(t *testing.T) {
 }
 
 func assertPolicyEqual(assert *assert.Assertions, expectedPolicy, policy Policy) {
+	assert.Equal(expectedPolicy.Name, policy.Name)
 	assert.Equal(expectedPolicy.Issuer, policy.Issuer)
-	assert.Equal(expectedPolicy.Algorithm, policy.Algorithm)
+	assert.Equal(expectedPolicy.Algorithms, policy.Algorithms)
 	assert.Equal(expectedPolicy.JwksURL, policy.JwksURL)
 	assert.Equal(expectedPolicy.AllowedScopes, policy.AllowedScopes)
+	assert.Equal(expectedPolicy.Effect, policy.Effect)
+	assert.Equal(expectedPolicy.DeniedScopes, policy.DeniedScopes)
 	assert.Equal(expectedPolicy.Subject, policy.Subject)
+	assert.Equal(expectedPolicy.Audience, policy.Audience)
+	if expectedPolicy.SubjectPattern == nil {
+		assert.Nil(policy.SubjectPattern)
+	} else if assert.NotNil(policy.SubjectPattern) {
+		assert.Equal(expectedPolicy.SubjectPattern.Kind, policy.SubjectPattern.Kind)
+		assert.Equal(expectedPolicy.SubjectPattern.Value, policy.SubjectPattern.Value)
+	}
+	assert.Equal(expectedPolicy.Condition, policy.Condition)
+	assert.Equal(len(expectedPolicy.Claims), len(policy.Claims))
+	for name, expectedMatcher := range expectedPolicy.Claims {
+		assert.Equal(expectedMatcher.Kind, policy.Claims[name].Kind, "claim %s", name)
+		assert.Equal(expectedMatcher.Values, policy.Claims[name].Values, "claim %s", name)
+	}
 }
@@ -0,0 +1,257 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Holds the active set of policies. The set is swapped atomically, so readers never observe a partially loaded set.
+type Store struct {
+	policies atomic.Pointer[PolicyList]
+}
+
+func NewStore(policies PolicyList) *Store {
+	s := &Store{}
+	s.Swap(policies)
+	return s
+}
+
+func (s *Store) Policies() PolicyList {
+	policies := s.policies.Load()
+	if policies == nil {
+		return nil
+	}
+
+	return *policies
+}
+
+func (s *Store) Swap(policies PolicyList) {
+	s.policies.Store(&policies)
+}
+
+// How long the policies directory must be quiet before a change triggers a reload.
+// Editors and config management tools usually write several events per change.
+const reloadDebounce = 500 * time.Millisecond
+
+// Loads policies from a directory into a Store, and reloads them when asked to or when the directory changes.
+type Reloader struct {
+	logger *slog.Logger
+	dir    string
+	opts   ReadOptions
+	// names of the backends that policies may reference. Policies without a backend use the default one
+	backends []string
+	cache    *JwksCache
+	store    *Store
+
+	// serializes reloads and guards keys
+	mu sync.Mutex
+	// the keys of the active set, by policy name
+	keys map[string]*activeKeys
+}
+
+// The keys of a policy in the active set. They keep loading and refreshing in the background until a set no longer uses them.
+type activeKeys struct {
+	source string
+	jwks   keyfunc.Keyfunc
+	cancel context.CancelFunc
+}
+
+// backends are the names of the backends that policies may reference.
+// cache may be nil, in which case no JWKS snapshots are kept
+func NewReloader(logger *slog.Logger, dir string, opts ReadOptions, backends []string, cache *JwksCache) *Reloader {
+	return &Reloader{
+		logger:   logger,
+		dir:      dir,
+		opts:     opts,
+		backends: backends,
+		cache:    cache,
+		store:    NewStore(nil),
+	}
+}
+
+func (r *Reloader) Store() *Store {
+	return r.store
+}
+
+// Reads and validates every policy, starts loading their keys, then swaps them in as the active set.
+// Keys fetched from a JWKS endpoint load in the background, so a reload never waits on an issuer.
+// If reading or validating fails, the previously active set is kept. Keys that fail to load are retried in the background,
+// and tokens checked against them fail with ErrJWKSUnavailable in the meantime. JWKS snapshots in the cache stand in for the keys until they load.
+// Policies whose key source did not change keep the keys of the previous set, if those have loaded.
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	policies, err := ReadFromDir(r.dir, r.opts)
+	if err != nil {
+		return fmt.Errorf("failed to get policies: %w", err)
+	}
+
+	err = errors.Join(ValidatePolicies(policies), ValidateBackends(policies, r.backends))
+	if err != nil {
+		return fmt.Errorf("failed to validate policies: %w", err)
+	}
+
+	keys := make([]*activeKeys, len(policies))
+	active := make(map[string]*activeKeys, len(policies))
+	reused := 0
+	for i := range policies {
+		policy := &policies[i]
+		source := policy.keySource()
+
+		previous, ok := r.keys[policy.Name]
+		if ok && previous.source == source && (Policy{Jwks: previous.jwks}).KeysHealth().Loaded {
+			policy.Jwks = previous.jwks
+			reused++
+		} else {
+			keysCtx, cancel := context.WithCancel(ctx)
+			// does not wait on the issuer, so that an unreachable issuer holds up neither the reload nor the other policies
+			policy.loadKeys(keysCtx, r.logger, r.cache)
+			previous = &activeKeys{source: source, jwks: policy.Jwks, cancel: cancel}
+		}
+
+		keys[i] = previous
+		active[policy.Name] = previous
+	}
+
+	r.store.Swap(policies)
+
+	// stop refreshing the keys the new set no longer uses
+	for _, previous := range r.keys {
+		if !slices.Contains(keys, previous) {
+			previous.cancel()
+		}
+	}
+	r.keys = active
+
+	pending := 0
+	for _, p := range policies {
+		if !p.KeysHealth().Loaded {
+			pending++
+		}
+	}
+
+	r.logger.Info("Policies loaded", "count", len(policies), "keysPending", pending, "keysKept", reused)
+
+	return nil
+}
+
+// Watches the policies directory and its subdirectories, reloading the policies after every change to a file that is read as a policy,
+// and after directories are created or removed. Failed reloads are logged and keep the previously active set. Watching stops when ctx is done.
+func (r *Reloader) Watch(ctx context.Context) error {
+	selector, err := r.opts.selector()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	// the watched directories, to tell when a removed path was a directory
+	dirs := make(map[string]bool)
+	err = watchRecursive(watcher, r.dir, dirs)
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch policies directory: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if !r.relevant(watcher, selector, dirs, event) {
+					continue
+				}
+
+				r.logger.Debug("Policies directory changed", "event", event)
+				debounce = time.After(reloadDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.logger.Error("Policies watcher error", "error", err)
+			case <-debounce:
+				debounce = nil
+				err := r.Reload(ctx)
+				if err != nil {
+					r.logger.Error("Failed to reload policies, keeping the previous policies", "error", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// relevant reports whether an event may change the policies. Events for files that are not read as policies,
+// such as editor swap files and excluded files, are ignored. Directories created after the watch started are watched too.
+func (r *Reloader) relevant(watcher *fsnotify.Watcher, selector fileSelector, dirs map[string]bool, event fsnotify.Event) bool {
+	if event.Has(fsnotify.Create) {
+		info, err := os.Stat(event.Name)
+		if err == nil && info.IsDir() {
+			err = watchRecursive(watcher, event.Name, dirs)
+			if err != nil {
+				r.logger.Error("Failed to watch new directory", "dir", event.Name, "error", err)
+			}
+			return true
+		}
+	}
+
+	// the policies in a directory that is removed or moved away do not get events of their own
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		if dirs[event.Name] {
+			for dir := range dirs {
+				if dir == event.Name || strings.HasPrefix(dir, event.Name+string(filepath.Separator)) {
+					delete(dirs, dir)
+				}
+			}
+			return true
+		}
+	}
+
+	rel, err := filepath.Rel(r.dir, event.Name)
+	if err != nil {
+		return true
+	}
+
+	return selector.selects(filepath.ToSlash(rel))
+}
+
+func watchRecursive(watcher *fsnotify.Watcher, dir string, dirs map[string]bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			return nil
+		}
+
+		dirs[path] = true
+		return watcher.Add(path)
+	})
+}
@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	require := require.New(t)
+	ctx := t.Context()
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	jwksURL := spawnJwksServer(t, logger)
+	dir := t.TempDir()
+
+	writePolicy(t, dir, "policy1.toml", jwksURL, `["acls"]`)
+
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, nil)
+	require.NoError(reloader.Reload(ctx))
+	require.Len(reloader.Store().Policies(), 1)
+
+	// a set that fails validation keeps the previous set active
+	writePolicy(t, dir, "policy2.toml", jwksURL, `[]`)
+	err := reloader.Reload(ctx)
+	require.Error(err)
+	require.Contains(err.Error(), "failed to validate policies")
+	require.Len(reloader.Store().Policies(), 1)
+
+	// a set that fails to parse keeps the previous set active
+	require.NoError(os.WriteFile(filepath.Join(dir, "policy2.toml"), []byte("issuer = "), 0o644))
+	err = reloader.Reload(ctx)
+	require.Error(err)
+	require.Contains(err.Error(), "failed to get policies")
+	require.Len(reloader.Store().Policies(), 1)
+
+	writePolicy(t, dir, "policy2.toml", jwksURL, `["devices:read"]`)
+	require.NoError(reloader.Reload(ctx))
+	require.Len(reloader.Store().Policies(), 2)
+}
+
+func TestWatch(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	jwksURL := spawnJwksServer(t, logger)
+	dir := t.TempDir()
+
+	writePolicy(t, dir, "policy1.toml", jwksURL, `["acls"]`)
+
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, nil)
+	require.NoError(reloader.Reload(ctx))
+	require.NoError(reloader.Watch(ctx))
+
+	writePolicy(t, dir, "policy2.toml", jwksURL, `["devices:read"]`)
+	assert.Eventually(t, func() bool {
+		return len(reloader.Store().Policies()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// policies in directories created after the watch started are picked up
+	require.NoError(os.Mkdir(filepath.Join(dir, "team"), 0o755))
+	time.Sleep(2 * reloadDebounce)
+	writePolicy(t, filepath.Join(dir, "team"), "policy3.toml", jwksURL, `["routes"]`)
+	assert.Eventually(t, func() bool {
+		return len(reloader.Store().Policies()) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestReloadKeepsKeys(t *testing.T) {
+	require := require.New(t)
+	ctx := t.Context()
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	dir := t.TempDir()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	var fetches atomic.Int32
+	handler := jwks.NewJWKSHandler(logger, key, "test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	jwksURL := srv.URL + "/jwks"
+
+	writePolicy(t, dir, "policy1.toml", jwksURL, `["acls"]`)
+
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, nil)
+	require.NoError(reloader.Reload(ctx))
+	require.Eventually(func() bool {
+		return reloader.Store().Policies()[0].KeysHealth().Loaded
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(1, fetches.Load())
+
+	// an unchanged key source keeps its keys, even when the rest of the policy changes
+	writePolicy(t, dir, "policy1.toml", jwksURL, `["acls", "devices:read"]`)
+	require.NoError(reloader.Reload(ctx))
+	require.EqualValues(1, fetches.Load())
+	require.True(reloader.Store().Policies()[0].KeysHealth().Loaded)
+
+	writePolicy(t, dir, "policy1.toml", jwksURL+"?v=2", `["acls"]`)
+	require.NoError(reloader.Reload(ctx))
+	require.Eventually(func() bool {
+		return fetches.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloadDoesNotWaitForKeys(t *testing.T) {
+	require := require.New(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	dir := t.TempDir()
+
+	// an issuer that never answers while the test runs
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hang) })
+
+	writePolicy(t, dir, "hanging.toml", srv.URL+"/jwks", `["acls"]`)
+	writePolicy(t, dir, "healthy.toml", spawnJwksServer(t, logger), `["acls"]`)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	reloader := NewReloader(logger, dir, ReadOptions{}, nil, nil)
+	start := time.Now()
+	require.NoError(reloader.Reload(ctx))
+	require.Less(time.Since(start), time.Second)
+
+	// policies are read in lexical order
+	hanging, healthy := reloader.Store().Policies()[0], reloader.Store().Policies()[1]
+	require.Eventually(func() bool {
+		return healthy.KeysHealth().Loaded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := hanging.Jwks.Keyfunc(&jwt.Token{Header: map[string]any{"kid": "test"}})
+	require.ErrorIs(err, ErrJWKSUnavailable)
+}
+
+func TestWatchIgnoresUnselectedFiles(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	jwksURL := spawnJwksServer(t, logger)
+	dir := t.TempDir()
+
+	writePolicy(t, dir, "policy1.toml", jwksURL, `["acls"]`)
+
+	reloader := NewReloader(logger, dir, ReadOptions{Exclude: []string{"draft-*"}}, nil, nil)
+	require.NoError(reloader.Reload(ctx))
+	require.NoError(reloader.Watch(ctx))
+	active := reloader.store.policies.Load()
+
+	require.NoError(os.WriteFile(filepath.Join(dir, ".policy1.toml.swp"), []byte("swap"), 0o644))
+	writePolicy(t, dir, "draft-policy2.toml", jwksURL, `["devices:read"]`)
+	time.Sleep(3 * reloadDebounce)
+	require.Same(active, reloader.store.policies.Load())
+
+	writePolicy(t, dir, "policy2.toml", jwksURL, `["devices:read"]`)
+	assert.Eventually(t, func() bool {
+		return len(reloader.Store().Policies()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func spawnJwksServer(t *testing.T, logger *slog.Logger) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(jwks.NewJWKSHandler(logger, key, "test"))
+	t.Cleanup(srv.Close)
+
+	return srv.URL + "/jwks"
+}
+
+func writePolicy(t *testing.T, dir, name, jwksURL, scopes string) {
+	t.Helper()
+
+	contents := fmt.Sprintf(`issuer = "http://localhost:8888"
+algorithm = "RS256"
+jwks_url = %q
+allowed_scopes = %s
+`, jwksURL, scopes)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644))
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrTokenTooOld          = errors.New("token too old")
+	ErrTokenLifetimeTooLong = errors.New("token lifetime too long")
+)
+
+// Whether tokens must carry an exp claim, which they must unless the policy says otherwise
+func (p Policy) requiresExp() bool {
+	return p.RequireExp == nil || *p.RequireExp
+}
+
+// Whether tokens must carry an iat claim, either because the policy says so or because their age or lifetime is limited
+func (p Policy) requiresIat() bool {
+	return p.RequireIat || p.MaxTokenAge > 0 || p.MaxTokenLifetime > 0
+}
+
+// ParserOptions returns the options a token is parsed and validated with under the policy
+func (p Policy) ParserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(p.Algorithms),
+		jwt.WithLeeway(time.Duration(p.Leeway)),
+	}
+
+	if p.requiresExp() {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+
+	if p.requiresIat() {
+		// rejects tokens issued in the future
+		opts = append(opts, jwt.WithIssuedAt())
+	}
+
+	return opts
+}
+
+// ValidateTokenTimes checks the claims of a verified token against the policy's limits on token age and lifetime.
+// The checks of exp, nbf and iat that the parser makes are not repeated.
+func (p Policy) ValidateTokenTimes(claims jwt.Claims, now time.Time) error {
+	if !p.requiresIat() {
+		return nil
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return err
+	}
+
+	if iat == nil {
+		return fmt.Errorf("%w: iat", jwt.ErrTokenRequiredClaimMissing)
+	}
+
+	if p.MaxTokenAge > 0 {
+		age := now.Sub(iat.Time)
+		if age > time.Duration(p.MaxTokenAge)+time.Duration(p.Leeway) {
+			return fmt.Errorf("%w: issued %s ago, at most %s is allowed", ErrTokenTooOld, age.Truncate(time.Second), time.Duration(p.MaxTokenAge))
+		}
+	}
+
+	if p.MaxTokenLifetime > 0 {
+		exp, err := claims.GetExpirationTime()
+		if err != nil {
+			return err
+		}
+
+		if exp == nil {
+			return fmt.Errorf("%w: exp", jwt.ErrTokenRequiredClaimMissing)
+		}
+
+		lifetime := exp.Sub(iat.Time)
+		if lifetime > time.Duration(p.MaxTokenLifetime) {
+			return fmt.Errorf("%w: valid for %s, at most %s is allowed", ErrTokenLifetimeTooLong, lifetime, time.Duration(p.MaxTokenLifetime))
+		}
+	}
+
+	return nil
+}
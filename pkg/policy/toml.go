@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// A list of strings that may be written in TOML as either a single string or an array of strings
+type StringList []string
+
+var _ unstable.Unmarshaler = (*StringList)(nil)
+
+func (s *StringList) UnmarshalTOML(data []byte) error {
+	value, err := decodeRaw(data)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		*s = StringList{v}
+	case []any:
+		list, err := toStrings(v)
+		if err != nil {
+			return err
+		}
+		*s = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings, found %T", value)
+	}
+
+	return nil
+}
+
+// A duration written in TOML as a string such as "30s" or "5m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// decodeRaw decodes the raw TOML handed to an unstable.Unmarshaler into a generic value.
+// Plain values are handed over as-is, while tables are handed over as their key/value lines.
+func decodeRaw(data []byte) (any, error) {
+	var wrapper struct {
+		Value any `toml:"value"`
+	}
+	err := toml.Unmarshal(append([]byte("value = "), data...), &wrapper)
+	if err == nil {
+		return wrapper.Value, nil
+	}
+
+	var table map[string]any
+	tableErr := toml.Unmarshal(data, &table)
+	if tableErr != nil {
+		return nil, errors.Join(err, tableErr)
+	}
+
+	return table, nil
+}
@@ -1,43 +1,136 @@
 package policy
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 )
 
+// ValidatePolicies checks every policy, and that no two policies share a name
 func ValidatePolicies(policies PolicyList) error {
 	var result error
+	names := make(map[string]bool, len(policies))
 	for _, policy := range policies {
 		err := ValidatePolicy(policy)
 		result = errors.Join(result, err)
+
+		if policy.Name == "" {
+			continue
+		}
+		if names[policy.Name] {
+			result = errors.Join(result, fmt.Errorf("duplicate policy name %q", policy.Name))
+		}
+		names[policy.Name] = true
 	}
 
-	return nil
+	return result
+}
+
+// ValidateBackends checks that every policy references one of the backends, or none
+func ValidateBackends(policies PolicyList, backends []string) error {
+	var result error
+	for _, policy := range policies {
+		if policy.Backend != "" && !slices.Contains(backends, policy.Backend) {
+			result = errors.Join(result, fmt.Errorf("policy %s: unknown backend %q", policy.Name, policy.Backend))
+		}
+	}
+
+	return result
 }
 
 func ValidatePolicy(policy Policy) error {
 	var result error
-	err := validateAlgorithm(policy.Algorithm)
+	err := validateAlgorithms(policy.Algorithms)
 	result = errors.Join(result, err)
 
-	err = validateScopes(policy.AllowedScopes)
+	err = validateEffect(policy.Effect, policy.AllowedScopes, policy.DeniedScopes)
 	result = errors.Join(result, err)
 
 	err = validateIssuer(policy.Issuer)
 	result = errors.Join(result, err)
 
-	err = validateJWKSUrl(policy.JwksURL)
+	err = validateKeys(policy)
+	result = errors.Join(result, err)
+
+	err = validatePinnedKeys(policy.AllowedKids, policy.AllowedKeyThumbprints)
+	result = errors.Join(result, err)
+
+	err = validateTokenTimes(policy.MaxTokenAge, policy.MaxTokenLifetime, policy.Leeway)
+	result = errors.Join(result, err)
+
+	err = validateSingleUse(policy)
 	result = errors.Join(result, err)
 
+	err = validateKeyLimits(policy)
+	result = errors.Join(result, err)
+
+	err = validateAudience(policy.Audience)
+	result = errors.Join(result, err)
+
+	err = validateSubject(policy.Subject, policy.SubjectPattern)
+	result = errors.Join(result, err)
+
+	err = validateClaims(policy.Claims)
+	result = errors.Join(result, err)
+
+	err = validateCondition(policy.Condition)
+	result = errors.Join(result, err)
+
+	return result
+}
+
+// The asymmetric algorithms that golang-jwt and keyfunc can verify
+var supportedAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+func validateAlgorithms(algs []string) error {
+	if len(algs) == 0 {
+		return errors.New("unsupported algorithm: no algorithm")
+	}
+
+	var result error
+	for _, alg := range algs {
+		result = errors.Join(result, validateAlgorithm(alg))
+	}
+
 	return result
 }
 
 func validateAlgorithm(alg string) error {
-	switch alg {
-	case "RS256":
+	switch {
+	case slices.Contains(supportedAlgorithms, alg):
 		return nil
+	case strings.HasPrefix(alg, "HS"):
+		// tokens signed with a shared secret cannot be verified with an issuer's public keys
+		return fmt.Errorf("unsupported algorithm %s: HMAC algorithms are not supported", alg)
 	default:
-		return errors.New("unsupported algorithm")
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+}
+
+func validateEffect(effect Effect, allowedScopes, deniedScopes []string) error {
+	switch effect {
+	case "", EffectAllow:
+		if len(deniedScopes) != 0 {
+			return errors.New("denied_scopes is only valid for deny policies")
+		}
+		return validateScopes(allowedScopes)
+	case EffectDeny:
+		if len(allowedScopes) != 0 {
+			return errors.New("allowed_scopes is not valid for deny policies")
+		}
+		return validateScopes(deniedScopes)
+	default:
+		return fmt.Errorf("unsupported effect %q", effect)
 	}
 }
 
@@ -57,9 +150,48 @@ func validateIssuer(issuer string) error {
 	return nil
 }
 
-func validateJWKSUrl(jwksURL string) error {
+// validateKeys checks that the policy's keys come from one place: keys supplied by the policy, a JWKS URL, or discovery
+func validateKeys(policy Policy) error {
+	if !policy.hasStaticKeys() {
+		return validateJWKSUrl(policy.JwksURL, policy.Issuer)
+	}
+
+	var result error
+	if policy.JwksURL != "" {
+		result = errors.Join(result, errors.New("jwks_url cannot be combined with jwks_inline, jwks_file, public_keys or public_key_files"))
+	}
+
+	if policy.KeyRefreshInterval < 0 {
+		result = errors.Join(result, errors.New("negative key_refresh_interval"))
+	}
+
+	// inline keys can be checked now, key files are read when the keys are loaded
+	if policy.JwksInline != "" {
+		_, err := parseJWKS([]byte(policy.JwksInline))
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("invalid inline JWKS: %w", err))
+		}
+	}
+
+	for i, key := range policy.PublicKeys {
+		_, err := parsePublicKeys([]byte(key))
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("invalid public key %d: %w", i, err))
+		}
+	}
+
+	return result
+}
+
+func validateJWKSUrl(jwksURL, issuer string) error {
 	if jwksURL == "" {
-		return errors.New("no JWKS URL")
+		// the JWKS URL is discovered from the issuer, which must then be a URL
+		u, err := url.Parse(issuer)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("no JWKS URL, and the issuer is not a URL it can be discovered from")
+		}
+
+		return nil
 	}
 
 	_, err := url.Parse(jwksURL)
@@ -69,3 +201,142 @@ func validateJWKSUrl(jwksURL string) error {
 
 	return nil
 }
+
+func validatePinnedKeys(kids, thumbprints []string) error {
+	var result error
+	if slices.Contains(kids, "") {
+		result = errors.Join(result, errors.New("empty kid in allowed_kids"))
+	}
+
+	for _, thumbprint := range thumbprints {
+		// a thumbprint is an unpadded base64url SHA-256 digest
+		digest, err := base64.RawURLEncoding.DecodeString(thumbprint)
+		if err != nil || len(digest) != sha256.Size {
+			result = errors.Join(result, fmt.Errorf("invalid key thumbprint %q", thumbprint))
+		}
+	}
+
+	return result
+}
+
+func validateTokenTimes(maxAge, maxLifetime, leeway Duration) error {
+	var result error
+	if maxAge < 0 {
+		result = errors.Join(result, errors.New("negative max_token_age"))
+	}
+
+	if maxLifetime < 0 {
+		result = errors.Join(result, errors.New("negative max_token_lifetime"))
+	}
+
+	if leeway < 0 {
+		result = errors.Join(result, errors.New("negative leeway"))
+	}
+
+	return result
+}
+
+func validateSingleUse(policy Policy) error {
+	if !policy.SingleUse {
+		return nil
+	}
+
+	if policy.IsDeny() {
+		return errors.New("single_use is not valid for deny policies")
+	}
+
+	// used token IDs are remembered until the tokens expire
+	if !policy.requiresExp() {
+		return errors.New("single_use requires exp")
+	}
+
+	return nil
+}
+
+func validateKeyLimits(policy Policy) error {
+	var result error
+	if policy.MaxKeyExpiry < 0 {
+		result = errors.Join(result, errors.New("negative max_key_expiry"))
+	}
+
+	if time.Duration(policy.MaxKeyExpiry) > TailscaleMaxKeyExpiry {
+		result = errors.Join(result, fmt.Errorf("max_key_expiry exceeds %s, the longest expiry Tailscale allows", TailscaleMaxKeyExpiry))
+	}
+
+	if len(policy.AllowedTags) == 0 {
+		return result
+	}
+
+	if policy.IsDeny() {
+		return errors.Join(result, errors.New("allowed_tags is not valid for deny policies"))
+	}
+
+	if !slices.Contains(policy.AllowedScopes, AuthKeysScope) {
+		result = errors.Join(result, fmt.Errorf("allowed_tags requires %s in allowed_scopes", AuthKeysScope))
+	}
+
+	for _, tag := range policy.AllowedTags {
+		if !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") {
+			result = errors.Join(result, fmt.Errorf("invalid tag %q, tags look like tag:name", tag))
+		}
+	}
+
+	return result
+}
+
+func validateAudience(audience []string) error {
+	for _, aud := range audience {
+		if aud == "" {
+			return errors.New("empty audience")
+		}
+	}
+
+	return nil
+}
+
+func validateSubject(subject *string, pattern *Pattern) error {
+	if pattern == nil {
+		return nil
+	}
+
+	if subject != nil {
+		return errors.New("subject and subject_pattern are mutually exclusive")
+	}
+
+	err := pattern.compile()
+	if err != nil {
+		return fmt.Errorf("invalid subject pattern: %w", err)
+	}
+
+	return nil
+}
+
+func validateClaims(claims map[string]ClaimMatcher) error {
+	var result error
+	for name, matcher := range claims {
+		if name == "" {
+			result = errors.Join(result, errors.New("empty claim name"))
+			continue
+		}
+
+		err := matcher.compile()
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("invalid matcher for claim %s: %w", name, err))
+		}
+	}
+
+	return result
+}
+
+func validateCondition(condition string) error {
+	if condition == "" {
+		return nil
+	}
+
+	_, err := compileCondition(condition)
+	if err != nil {
+		return fmt.Errorf("invalid condition: %w", err)
+	}
+
+	return nil
+}
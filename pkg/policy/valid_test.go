@@ -2,11 +2,14 @@ package policy
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestValidatePolicy(t *testing.T) {
+	subject := "repo:acme/app:ref:refs/heads/main"
+
 	cases := map[string]struct {
 		policy      Policy
 		errContains string
@@ -14,7 +17,7 @@ func TestValidatePolicy(t *testing.T) {
 		"valid policy": {
 			policy: Policy{
 				Issuer:        "http://localhost:8888",
-				Algorithm:     "RS256",
+				Algorithms:    StringList{"RS256"},
 				Subject:       nil,
 				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
 				AllowedScopes: []string{"acls", "devices:read"},
@@ -22,7 +25,7 @@ func TestValidatePolicy(t *testing.T) {
 		},
 		"missing issuer": {
 			policy: Policy{
-				Algorithm:     "RS256",
+				Algorithms:    StringList{"RS256"},
 				Subject:       nil,
 				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
 				AllowedScopes: []string{"acls", "devices:read"},
@@ -38,24 +41,279 @@ func TestValidatePolicy(t *testing.T) {
 			},
 			errContains: "unsupported algorithm",
 		},
-		"missing jwks url": {
+		"several supported algorithms": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"ES256", "EdDSA", "PS512"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+		},
+		"HMAC algorithm": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256", "HS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "HMAC algorithms are not supported",
+		},
+		"unknown algorithm": {
 			policy: Policy{
 				Issuer:        "http://localhost:8888",
-				Algorithm:     "RS256",
+				Algorithms:    StringList{"none"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "unsupported algorithm none",
+		},
+		"missing jwks url is discovered from the issuer": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				Subject:       nil,
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+		},
+		"missing jwks url with an issuer that is not a URL": {
+			policy: Policy{
+				Issuer:        "kubernetes",
+				Algorithms:    StringList{"RS256"},
 				Subject:       nil,
 				AllowedScopes: []string{"acls", "devices:read"},
 			},
 			errContains: "no JWKS URL",
 		},
+		"key file with an issuer that is not a URL": {
+			policy: Policy{
+				Issuer:         "kubernetes",
+				Algorithms:     StringList{"RS256"},
+				PublicKeyFiles: StringList{"/etc/keys/sa.pem"},
+				AllowedScopes:  []string{"acls", "devices:read"},
+			},
+		},
+		"static keys combined with a jwks url": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				JwksFile:      "/etc/keys/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "jwks_url cannot be combined",
+		},
+		"invalid inline jwks": {
+			policy: Policy{
+				Issuer:        "kubernetes",
+				Algorithms:    StringList{"RS256"},
+				JwksInline:    `{"keys": [`,
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "invalid inline JWKS",
+		},
+		"invalid inline public key": {
+			policy: Policy{
+				Issuer:        "kubernetes",
+				Algorithms:    StringList{"RS256"},
+				PublicKeys:    StringList{"not a key"},
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "invalid public key 0",
+		},
+		"negative key refresh interval": {
+			policy: Policy{
+				Issuer:             "kubernetes",
+				Algorithms:         StringList{"RS256"},
+				JwksFile:           "/etc/keys/jwks.json",
+				KeyRefreshInterval: Duration(-time.Minute),
+				AllowedScopes:      []string{"acls", "devices:read"},
+			},
+			errContains: "negative key_refresh_interval",
+		},
+		"negative max token age": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				MaxTokenAge:   Duration(-time.Minute),
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "negative max_token_age",
+		},
+		"single use without exp": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				RequireExp:    new(bool),
+				SingleUse:     true,
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "single_use requires exp",
+		},
+		"allowed tags without auth_keys scope": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedTags:   StringList{"tag:ci"},
+				AllowedScopes: []string{"devices:read"},
+			},
+			errContains: "allowed_tags requires auth_keys in allowed_scopes",
+		},
+		"invalid allowed tag": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedTags:   StringList{"ci"},
+				AllowedScopes: []string{"auth_keys"},
+			},
+			errContains: "invalid tag \"ci\"",
+		},
+		"negative max key expiry": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				MaxKeyExpiry:  Duration(-time.Minute),
+				AllowedScopes: []string{"auth_keys"},
+			},
+			errContains: "negative max_key_expiry",
+		},
+		"max key expiry beyond what Tailscale allows": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				MaxKeyExpiry:  Duration(91 * 24 * time.Hour),
+				AllowedScopes: []string{"auth_keys"},
+			},
+			errContains: "max_key_expiry exceeds",
+		},
 		"missing allowed scopes": {
 			policy: Policy{
-				Issuer:    "http://localhost:8888",
-				Algorithm: "RS256",
-				Subject:   nil,
-				JwksURL:   "http://localhost:8888/.well-known/jwks.json",
+				Issuer:     "http://localhost:8888",
+				Algorithms: StringList{"RS256"},
+				Subject:    nil,
+				JwksURL:    "http://localhost:8888/.well-known/jwks.json",
+			},
+			errContains: "no scopes",
+		},
+		"empty audience": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				Audience:      StringList{""},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+			},
+			errContains: "empty audience",
+		},
+		"invalid claim regex": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+				Claims: map[string]ClaimMatcher{
+					"ref": {Kind: MatchRegex, Values: []string{"refs/(heads"}},
+				},
+			},
+			errContains: "invalid matcher for claim ref",
+		},
+		"empty one of claim matcher": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+				Claims: map[string]ClaimMatcher{
+					"environment": {Kind: MatchOneOf},
+				},
+			},
+			errContains: "one_of matcher has no values",
+		},
+		"invalid subject pattern": {
+			policy: Policy{
+				Issuer:         "http://localhost:8888",
+				Algorithms:     StringList{"RS256"},
+				SubjectPattern: &Pattern{Kind: MatchRegex, Value: "repo:acme/(app"},
+				JwksURL:        "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes:  []string{"acls", "devices:read"},
+			},
+			errContains: "invalid subject pattern",
+		},
+		"subject and subject pattern": {
+			policy: Policy{
+				Issuer:         "http://localhost:8888",
+				Algorithms:     StringList{"RS256"},
+				Subject:        &subject,
+				SubjectPattern: &Pattern{Kind: MatchGlob, Value: "repo:acme/*"},
+				JwksURL:        "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes:  []string{"acls", "devices:read"},
+			},
+			errContains: "mutually exclusive",
+		},
+		"invalid condition": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"acls", "devices:read"},
+				Condition:     `claims.environment`,
+			},
+			errContains: "invalid condition",
+		},
+		"valid deny policy": {
+			policy: Policy{
+				Issuer:       "http://localhost:8888",
+				Algorithms:   StringList{"RS256"},
+				JwksURL:      "http://localhost:8888/.well-known/jwks.json",
+				Effect:       EffectDeny,
+				DeniedScopes: []string{"acls"},
+			},
+		},
+		"deny policy without denied scopes": {
+			policy: Policy{
+				Issuer:     "http://localhost:8888",
+				Algorithms: StringList{"RS256"},
+				JwksURL:    "http://localhost:8888/.well-known/jwks.json",
+				Effect:     EffectDeny,
 			},
 			errContains: "no scopes",
 		},
+		"deny policy with allowed scopes": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				Effect:        EffectDeny,
+				AllowedScopes: []string{"devices:read"},
+				DeniedScopes:  []string{"acls"},
+			},
+			errContains: "allowed_scopes is not valid for deny policies",
+		},
+		"allow policy with denied scopes": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				AllowedScopes: []string{"devices:read"},
+				DeniedScopes:  []string{"acls"},
+			},
+			errContains: "denied_scopes is only valid for deny policies",
+		},
+		"unknown effect": {
+			policy: Policy{
+				Issuer:        "http://localhost:8888",
+				Algorithms:    StringList{"RS256"},
+				JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+				Effect:        "audit",
+				AllowedScopes: []string{"devices:read"},
+			},
+			errContains: "unsupported effect",
+		},
 	}
 
 	for name, tc := range cases {
@@ -70,3 +328,42 @@ func TestValidatePolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestValidatePolicies(t *testing.T) {
+	valid := Policy{
+		Issuer:        "http://localhost:8888",
+		Algorithms:    StringList{"RS256"},
+		JwksURL:       "http://localhost:8888/.well-known/jwks.json",
+		AllowedScopes: []string{"acls"},
+	}
+	invalid := Policy{
+		Issuer:     "http://localhost:8888",
+		Algorithms: StringList{"RS256"},
+		JwksURL:    "http://localhost:8888/.well-known/jwks.json",
+	}
+
+	require.NoError(t, ValidatePolicies(PolicyList{valid, valid}))
+
+	err := ValidatePolicies(PolicyList{valid, invalid})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no scopes")
+
+	// names identify policies in logs and responses, and their keys across reloads
+	first, second := valid, valid
+	first.Name, second.Name = "ci", "ci"
+	second.JwksURL = "http://localhost:9999/.well-known/jwks.json"
+	err = ValidatePolicies(PolicyList{first, second})
+	require.ErrorContains(t, err, `duplicate policy name "ci"`)
+}
+
+func TestValidateBackends(t *testing.T) {
+	policies := PolicyList{
+		{Name: "default"},
+		{Name: "prod", Backend: "prod"},
+	}
+
+	require.NoError(t, ValidateBackends(policies, []string{"prod", "lab"}))
+
+	err := ValidateBackends(policies, nil)
+	require.ErrorContains(t, err, `policy prod: unknown backend "prod"`)
+}
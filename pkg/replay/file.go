@@ -0,0 +1,216 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How many IDs a FileStore records between compactions of its file
+const compactEvery = 1000
+
+// A Store that persists used IDs to a file, so that they are remembered across restarts.
+// The file holds a JSON object per line, the last line of an ID winning, and is compacted to the unexpired IDs when the store is opened and periodically after.
+type FileStore struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	ids  map[string]time.Time
+	// IDs recorded since the file was last compacted
+	written int
+	now     func() time.Time
+}
+
+type fileEntry struct {
+	ID  string    `json:"id"`
+	Exp time.Time `json:"exp"`
+}
+
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore opens the store at path, creating it if it does not exist
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		ids:  make(map[string]time.Time),
+		now:  time.Now,
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Use(id string, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if recorded, ok := s.ids[id]; ok && now.Before(recorded) {
+		return ErrReplayed
+	}
+
+	err := s.write(fileEntry{ID: id, Exp: exp})
+	if err != nil {
+		return fmt.Errorf("failed to record used token: %w", err)
+	}
+
+	s.ids[id] = exp
+	s.written++
+
+	if s.written >= compactEvery {
+		err = s.compact()
+		if err != nil {
+			return fmt.Errorf("failed to compact used tokens: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) Release(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[id]; !ok {
+		return nil
+	}
+
+	// recorded as having expired already, which overrides the recorded use when the file is loaded
+	err := s.write(fileEntry{ID: id})
+	if err != nil {
+		return fmt.Errorf("failed to release used token: %w", err)
+	}
+
+	delete(s.ids, id)
+	s.written++
+	return nil
+}
+
+func (s *FileStore) write(entry fileEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// load reads the IDs recorded in the file that have not expired
+func (s *FileStore) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open used tokens: %w", err)
+	}
+	defer file.Close()
+
+	now := s.now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry fileEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// a line cut short by a crash is the last one written, and is skipped
+			continue
+		}
+
+		if now.Before(entry.Exp) {
+			s.ids[entry.ID] = entry.Exp
+		} else {
+			delete(s.ids, entry.ID)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read used tokens: %w", err)
+	}
+
+	return nil
+}
+
+// compact forgets expired IDs and rewrites the file with the remaining ones, then reopens it for appending
+func (s *FileStore) compact() error {
+	now := s.now()
+	for id, exp := range s.ids {
+		if !now.Before(exp) {
+			delete(s.ids, id)
+		}
+	}
+
+	// write to a temporary file first, so a crash never loses the recorded IDs
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create used tokens: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for id, exp := range s.ids {
+		line, err := json.Marshal(fileEntry{ID: id, Exp: exp})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode used token: %w", err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write used tokens: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write used tokens: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to write used tokens: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open used tokens: %w", err)
+	}
+	s.written = 0
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "used-tokens")
+	now := time.Now()
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Use("a", now.Add(time.Hour)))
+	require.NoError(t, store.Use("expired", now.Add(-time.Minute)))
+	require.ErrorIs(t, store.Use("a", now.Add(time.Hour)), ErrReplayed)
+	require.NoError(t, store.Close())
+
+	// used IDs are remembered after a restart
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	require.ErrorIs(t, store.Use("a", now.Add(time.Hour)), ErrReplayed)
+	require.NoError(t, store.Use("expired", now.Add(time.Hour)))
+	require.ErrorIs(t, store.Use("expired", now.Add(time.Hour)), ErrReplayed)
+}
+
+func TestFileStoreRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "used-tokens")
+	exp := time.Now().Add(time.Hour)
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Use("a", exp))
+	require.NoError(t, store.Use("b", exp))
+	require.NoError(t, store.Release("a"))
+	require.NoError(t, store.Release("unknown"))
+	require.NoError(t, store.Close())
+
+	// released IDs stay released after a restart
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	require.NoError(t, store.Use("a", exp))
+	require.ErrorIs(t, store.Use("b", exp), ErrReplayed)
+}
+
+func TestFileStoreSkipsTruncatedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "used-tokens")
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	contents := `{"id":"a","exp":"` + exp + `"}` + "\n" + `{"id":"b","ex`
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	require.ErrorIs(t, store.Use("a", time.Now().Add(time.Hour)), ErrReplayed)
+	require.NoError(t, store.Use("b", time.Now().Add(time.Hour)))
+}
+
+func TestFileStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "used-tokens")
+	now := time.Now()
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	for i := range compactEvery {
+		require.NoError(t, store.Use(fmt.Sprint(i), now.Add(-time.Second)))
+	}
+	require.NoError(t, store.Use("live", now.Add(time.Hour)))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(contents), `"live"`)
+	require.Less(t, len(contents), 100)
+}
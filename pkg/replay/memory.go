@@ -0,0 +1,102 @@
+package replay
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// The number of IDs a MemoryStore remembers when no capacity is given
+const DefaultCapacity = 100_000
+
+// A Store that keeps used IDs in memory, forgetting them when they expire or on restart.
+// When full, the least recently used ID is evicted, even if it has not expired yet.
+type MemoryStore struct {
+	capacity int
+
+	mu sync.Mutex
+	// most recently used at the front
+	order *list.List
+	ids   map[string]*list.Element
+	now   func() time.Time
+}
+
+type memoryEntry struct {
+	id  string
+	exp time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+
+	return &MemoryStore{
+		capacity: capacity,
+		order:    list.New(),
+		ids:      make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) Use(id string, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if element, ok := s.ids[id]; ok {
+		entry := element.Value.(memoryEntry)
+		if now.Before(entry.exp) {
+			s.order.MoveToFront(element)
+			return ErrReplayed
+		}
+
+		s.order.Remove(element)
+		delete(s.ids, id)
+	}
+
+	s.evictExpired(now)
+	for s.order.Len() >= s.capacity {
+		s.remove(s.order.Back())
+	}
+
+	s.ids[id] = s.order.PushFront(memoryEntry{id: id, exp: exp})
+
+	return nil
+}
+
+func (s *MemoryStore) Release(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.ids[id]; ok {
+		s.remove(element)
+	}
+
+	return nil
+}
+
+// Len returns the number of IDs remembered
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// evictExpired forgets expired IDs, starting from the least recently used, until it finds one that has not expired
+func (s *MemoryStore) evictExpired(now time.Time) {
+	for element := s.order.Back(); element != nil; element = s.order.Back() {
+		if now.Before(element.Value.(memoryEntry).exp) {
+			return
+		}
+		s.remove(element)
+	}
+}
+
+func (s *MemoryStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.ids, element.Value.(memoryEntry).id)
+}
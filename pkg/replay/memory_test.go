@@ -0,0 +1,71 @@
+package replay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore(10)
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.Use("a", now.Add(time.Minute)))
+	require.ErrorIs(t, store.Use("a", now.Add(time.Minute)), ErrReplayed)
+	require.NoError(t, store.Use("b", now.Add(time.Minute)))
+
+	// an ID can be used again once it has expired
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, store.Use("a", now.Add(time.Minute)))
+	require.ErrorIs(t, store.Use("a", now.Add(time.Minute)), ErrReplayed)
+}
+
+func TestMemoryStoreRelease(t *testing.T) {
+	store := NewMemoryStore(10)
+	exp := time.Now().Add(time.Hour)
+
+	require.NoError(t, store.Use("a", exp))
+	require.NoError(t, store.Release("a"))
+	require.NoError(t, store.Release("unknown"))
+
+	require.NoError(t, store.Use("a", exp))
+	require.ErrorIs(t, store.Use("a", exp), ErrReplayed)
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore(3)
+	store.now = func() time.Time { return now }
+
+	for i := range 5 {
+		require.NoError(t, store.Use(fmt.Sprint(i), now.Add(time.Hour)))
+	}
+
+	require.Equal(t, 3, store.Len())
+	require.NoError(t, store.Use("0", now.Add(time.Hour)))
+	require.ErrorIs(t, store.Use("4", now.Add(time.Hour)), ErrReplayed)
+}
+
+func TestMemoryStoreConcurrentUse(t *testing.T) {
+	store := NewMemoryStore(0)
+	exp := time.Now().Add(time.Hour)
+
+	// exactly one of many concurrent uses of the same ID succeeds
+	results := make(chan error, 50)
+	for range 50 {
+		go func() {
+			results <- store.Use("token", exp)
+		}()
+	}
+
+	succeeded := 0
+	for range 50 {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	require.Equal(t, 1, succeeded)
+}
@@ -0,0 +1,17 @@
+// Package replay remembers the tokens that have been used, so that single-use tokens cannot be presented twice.
+package replay
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrReplayed = errors.New("token already used")
+
+// Remembers used token IDs until the tokens expire
+type Store interface {
+	// Use records the ID as used until exp. It returns ErrReplayed if the ID is already recorded and has not expired.
+	Use(id string, exp time.Time) error
+	// Release forgets an ID recorded by Use, so that a token whose request failed can be presented again
+	Release(id string) error
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+)
+
+const DefaultTailscaleAPIURL = "https://api.tailscale.com"
+
+// The tailnet of the OAuth client that created the access token
+const DefaultTailnet = "-"
+
+var errCreateKey = errors.New("failed to create tailscale auth key")
+
+// Creates Tailscale auth keys
+type AuthKeyCreator interface {
+	// CreateAuthKey creates an auth key using an access token with the auth_keys scope
+	CreateAuthKey(ctx context.Context, accessToken string, key policy.KeyRequest) (*AuthKey, error)
+}
+
+// A Tailscale auth key
+type AuthKey struct {
+	ID      string
+	Key     string
+	Expires time.Time
+}
+
+// An AuthKeyCreator that calls the Tailscale keys API
+type TailscaleKeyCreator struct {
+	apiURL  string
+	tailnet string
+	client  *http.Client
+}
+
+var _ AuthKeyCreator = (*TailscaleKeyCreator)(nil)
+
+func NewTailscaleKeyCreator(apiURL, tailnet string) *TailscaleKeyCreator {
+	return &TailscaleKeyCreator{
+		apiURL:  apiURL,
+		tailnet: tailnet,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// The body of a request to the Tailscale keys API
+type createKeyRequest struct {
+	Capabilities  keyCapabilities `json:"capabilities"`
+	ExpirySeconds int64           `json:"expirySeconds"`
+}
+
+type keyCapabilities struct {
+	Devices struct {
+		Create struct {
+			Reusable      bool     `json:"reusable"`
+			Ephemeral     bool     `json:"ephemeral"`
+			Preauthorized bool     `json:"preauthorized"`
+			Tags          []string `json:"tags"`
+		} `json:"create"`
+	} `json:"devices"`
+}
+
+// The body of a response of the Tailscale keys API
+type createKeyResponse struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Message string    `json:"message"`
+}
+
+func (c *TailscaleKeyCreator) CreateAuthKey(ctx context.Context, accessToken string, key policy.KeyRequest) (*AuthKey, error) {
+	var body createKeyRequest
+	body.Capabilities.Devices.Create.Reusable = key.Reusable
+	body.Capabilities.Devices.Create.Ephemeral = key.Ephemeral
+	body.Capabilities.Devices.Create.Preauthorized = key.Preauthorized
+	body.Capabilities.Devices.Create.Tags = key.Tags
+	body.ExpirySeconds = int64(key.Expiry.Seconds())
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	endpoint, err := url.JoinPath(c.apiURL, "api/v2/tailnet", c.tailnet, "keys")
+	if err != nil {
+		return nil, fmt.Errorf("invalid API URL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var created createKeyResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&created)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && created.Message != "" {
+			return nil, fmt.Errorf("keys API returned %s: %s", resp.Status, created.Message)
+		}
+		return nil, fmt.Errorf("keys API returned %s", resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &AuthKey{ID: created.ID, Key: created.Key, Expires: created.Expires}, nil
+}
+
+// The body of an auth key request
+type AuthKeyRequest struct {
+	Tags []string `json:"tags"`
+	// defaults to true
+	Ephemeral     *bool `json:"ephemeral"`
+	Preauthorized bool  `json:"preauthorized"`
+	Reusable      bool  `json:"reusable"`
+	// defaults to the longest expiry the policy allows
+	ExpirySeconds int64 `json:"expiry_seconds"`
+}
+
+// The response to an auth key request
+type AuthKeyResponse struct {
+	ID            string    `json:"id"`
+	Key           string    `json:"key"`
+	Expires       time.Time `json:"expires"`
+	Tags          []string  `json:"tags"`
+	Ephemeral     bool      `json:"ephemeral"`
+	Preauthorized bool      `json:"preauthorized"`
+	Reusable      bool      `json:"reusable"`
+	// the name of the policy that allowed the request
+	Policy string `json:"policy"`
+}
+
+// newAuthKeyHandler serves auth key requests, trading an OIDC token for a Tailscale auth key whose properties the policy allows
+func newAuthKeyHandler(e *exchanger) http.HandlerFunc {
+	logger := e.logger
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Debug("Auth key request received")
+
+		token, err := bearerToken(r)
+		if err != nil {
+			writeError(w, logger, e.failure(err))
+			return
+		}
+
+		var req AuthKeyRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			logger.Debug("Failed to decode request", "error", err)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "invalid request"})
+			return
+		}
+
+		if req.ExpirySeconds < 0 {
+			logger.Debug("Request with negative expiry", "expirySeconds", req.ExpirySeconds)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "negative expiry_seconds"})
+			return
+		}
+
+		// no policy allows a longer expiry, and larger values would overflow the conversion to a duration
+		if req.ExpirySeconds > int64(policy.TailscaleMaxKeyExpiry/time.Second) {
+			logger.Debug("Request with an expiry longer than Tailscale allows", "expirySeconds", req.ExpirySeconds)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "expiry_seconds too long"})
+			return
+		}
+
+		key := policy.KeyRequest{
+			Tags:          req.Tags,
+			Ephemeral:     req.Ephemeral == nil || *req.Ephemeral,
+			Preauthorized: req.Preauthorized,
+			Reusable:      req.Reusable,
+			Expiry:        time.Duration(req.ExpirySeconds) * time.Second,
+		}
+
+		logger.Debug("Auth key request decoded", "tags", key.Tags, "ephemeral", key.Ephemeral, "preauthorized", key.Preauthorized, "reusable", key.Reusable, "expiry", key.Expiry)
+
+		scopes := []string{policy.AuthKeysScope}
+		p, release, err := e.authorize(r, token, scopes, &key)
+		if err != nil {
+			writeError(w, logger, e.failure(err))
+			return
+		}
+
+		if key.Expiry == 0 {
+			key.Expiry = p.KeyExpiryLimit()
+		}
+
+		accessToken, err := e.fetch(r.Context(), p, scopes)
+		if err != nil {
+			release()
+			writeError(w, logger, e.failure(err))
+			return
+		}
+
+		// the key is created in the tailnet of the backend the access token was fetched from
+		backend, err := e.backend(p)
+		if err != nil {
+			release()
+			writeError(w, logger, e.failure(err))
+			return
+		}
+
+		authKey, err := backend.Keys.CreateAuthKey(r.Context(), accessToken.AccessToken, key)
+		if err != nil {
+			release()
+			writeError(w, logger, e.failure(fmt.Errorf("%w: %w", errCreateKey, err)))
+			return
+		}
+
+		logger.Info("Auth key created", "policy", p.Name, "keyId", authKey.ID, "tags", key.Tags, "expires", authKey.Expires)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		err = json.NewEncoder(w).Encode(AuthKeyResponse{
+			ID:            authKey.ID,
+			Key:           authKey.Key,
+			Expires:       authKey.Expires,
+			Tags:          key.Tags,
+			Ephemeral:     key.Ephemeral,
+			Preauthorized: key.Preauthorized,
+			Reusable:      key.Reusable,
+			Policy:        p.Name,
+		})
+		if err != nil {
+			logger.Error("Failed to send response", "error", err)
+			return
+		}
+
+		logger.Debug("Response sent")
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+var ErrNoClientForScopes = errors.New("no OAuth client can grant the requested scopes")
+
+// An OAuth client that can grant a fixed set of scopes
+type ScopedClient struct {
+	Name    string
+	Scopes  []string
+	Fetcher AccessTokenFetcher
+}
+
+// An AccessTokenFetcher that fetches every token from the least-privileged client that can grant all of the requested scopes
+type SelectingFetcher struct {
+	// sorted from least to most privileged
+	clients []ScopedClient
+}
+
+var _ AccessTokenFetcher = (*SelectingFetcher)(nil)
+
+func NewSelectingFetcher(clients []ScopedClient) (*SelectingFetcher, error) {
+	if len(clients) == 0 {
+		return nil, errors.New("no OAuth clients")
+	}
+
+	for _, client := range clients {
+		if len(client.Scopes) == 0 {
+			return nil, fmt.Errorf("OAuth client %s declares no scopes", client.Name)
+		}
+	}
+
+	sorted := slices.Clone(clients)
+	// stable, so that clients of equal privilege are tried in the order they are declared
+	slices.SortStableFunc(sorted, func(a, b ScopedClient) int {
+		return privilege(a.Scopes) - privilege(b.Scopes)
+	})
+
+	return &SelectingFetcher{clients: sorted}, nil
+}
+
+func (f *SelectingFetcher) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	client, err := f.Select(scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Fetcher.Fetch(ctx, scopes)
+}
+
+// Select returns the least-privileged client that can grant all of the scopes
+func (f *SelectingFetcher) Select(scopes []string) (ScopedClient, error) {
+	for _, client := range f.clients {
+		if coversScopes(client.Scopes, scopes) {
+			return client, nil
+		}
+	}
+
+	return ScopedClient{}, fmt.Errorf("%w: %s", ErrNoClientForScopes, strings.Join(scopes, " "))
+}
+
+// Scopes granting access to everything, or read access to everything
+const (
+	scopeAll     = "all"
+	scopeAllRead = "all:read"
+)
+
+// coversScopes reports whether the granted scopes include every requested scope
+func coversScopes(granted, requested []string) bool {
+	for _, scope := range requested {
+		if !slices.ContainsFunc(granted, func(g string) bool { return coversScope(g, scope) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// coversScope reports whether a granted scope includes the requested one.
+// A scope includes its read-only form, e.g. devices:core includes devices:core:read.
+func coversScope(granted, requested string) bool {
+	switch {
+	case granted == requested || granted == scopeAll:
+		return true
+	case granted == scopeAllRead:
+		return strings.HasSuffix(requested, ":read")
+	default:
+		return requested == granted+":read"
+	}
+}
+
+// privilege ranks a set of scopes, so that clients can be ordered from least to most privileged.
+// Clients with all or all:read rank above every client with specific scopes, then clients with more write scopes,
+// so that a read-only scope ranks below its write form, then clients with more scopes.
+func privilege(scopes []string) int {
+	const (
+		write = 1 << 8
+		broad = 1 << 16
+	)
+	rank := len(scopes)
+	for _, scope := range scopes {
+		if !strings.HasSuffix(scope, ":read") {
+			rank += write
+		}
+	}
+	if slices.Contains(scopes, scopeAllRead) {
+		rank += broad
+	}
+	if slices.Contains(scopes, scopeAll) {
+		rank += 2 * broad
+	}
+
+	return rank
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/jacobmichels/tail-sts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectingFetcherSelect(t *testing.T) {
+	clients := []ScopedClient{
+		{Name: "admin", Scopes: []string{"all"}},
+		{Name: "reader", Scopes: []string{"all:read"}},
+		{Name: "devices", Scopes: []string{"devices:core", "devices:routes"}},
+		{Name: "dns", Scopes: []string{"dns"}},
+		{Name: "keys", Scopes: []string{"auth_keys"}},
+	}
+	fetcher, err := NewSelectingFetcher(clients)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		scopes   []string
+		expected string
+	}{
+		"exact scope":                  {scopes: []string{"dns"}, expected: "dns"},
+		"read form of a granted scope": {scopes: []string{"dns:read"}, expected: "dns"},
+		"fewest scopes wins":           {scopes: []string{"devices:core:read"}, expected: "devices"},
+		"several scopes of one client": {scopes: []string{"devices:core", "devices:routes:read"}, expected: "devices"},
+		"all:read over all":            {scopes: []string{"acls:read"}, expected: "reader"},
+		"read of several clients":      {scopes: []string{"dns:read", "devices:core:read"}, expected: "reader"},
+		"write of several clients":     {scopes: []string{"dns", "devices:core"}, expected: "admin"},
+		"write of no specific client":  {scopes: []string{"acls"}, expected: "admin"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			client, err := fetcher.Select(tc.scopes)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, client.Name)
+		})
+	}
+}
+
+func TestSelectingFetcherPrefersReadOnlyClient(t *testing.T) {
+	// the write client is declared first, and has as many scopes as the read-only one
+	fetcher, err := NewSelectingFetcher([]ScopedClient{
+		{Name: "writer", Scopes: []string{"devices:core"}},
+		{Name: "reader", Scopes: []string{"devices:core:read"}},
+	})
+	require.NoError(t, err)
+
+	client, err := fetcher.Select([]string{"devices:core:read"})
+	require.NoError(t, err)
+	assert.Equal(t, "reader", client.Name)
+
+	client, err = fetcher.Select([]string{"devices:core"})
+	require.NoError(t, err)
+	assert.Equal(t, "writer", client.Name)
+}
+
+func TestSelectingFetcherNoClient(t *testing.T) {
+	fetcher, err := NewSelectingFetcher([]ScopedClient{
+		{Name: "reader", Scopes: []string{"all:read"}},
+		{Name: "dns", Scopes: []string{"dns"}},
+	})
+	require.NoError(t, err)
+
+	_, err = fetcher.Fetch(context.Background(), []string{"dns", "acls:read"})
+	require.ErrorIs(t, err, ErrNoClientForScopes)
+	assert.ErrorContains(t, err, "dns acls:read")
+}
+
+func TestNewSelectingFetcher(t *testing.T) {
+	_, err := NewSelectingFetcher(nil)
+	require.Error(t, err)
+
+	_, err = NewSelectingFetcher([]ScopedClient{{Name: "unscoped", Fetcher: &recordingFetcher{}}})
+	require.ErrorContains(t, err, "unscoped")
+}
+
+func TestSelectingFetcherFetch(t *testing.T) {
+	dns := &recordingFetcher{}
+	admin := &recordingFetcher{}
+	fetcher, err := NewSelectingFetcher([]ScopedClient{
+		{Name: "admin", Scopes: []string{"all"}, Fetcher: admin},
+		{Name: "dns", Scopes: []string{"dns"}, Fetcher: dns},
+	})
+	require.NoError(t, err)
+
+	_, err = fetcher.Fetch(context.Background(), []string{"dns:read"})
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), []string{"acls"})
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]string{{"dns:read"}}, dns.scopes)
+	assert.Equal(t, [][]string{{"acls"}}, admin.scopes)
+}
+
+func TestTokenRequestHandlerScopeUnavailable(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"dns", "acls"},
+		},
+	}
+	fetcher, err := NewSelectingFetcher([]ScopedClient{
+		{Name: "dns", Scopes: []string{"dns"}, Fetcher: &testutils.StaticFetcher{AccessToken: fakeAccessToken}},
+	})
+	require.NoError(t, err)
+	handler := NewTokenRequestHandler(log, policies, fetcher, &StaticVerifier{})
+
+	cases := map[string]struct {
+		body           string
+		expectedStatus int
+		expectedCode   ErrorCode
+	}{
+		"scope of a client": {
+			body:           `{"scopes":["dns"]}`,
+			expectedStatus: 200,
+		},
+		"scope of no client": {
+			body:           `{"scopes":["acls"]}`,
+			expectedStatus: 403,
+			expectedCode:   CodeScopeUnavailable,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+generateToken(t, defaultIssuer, defaultSubject))
+			req.Header.Set("Accept", "application/json")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+
+			if tc.expectedCode != "" {
+				var resp Error
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tc.expectedCode, resp.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable reason for a failed request.
+// Clients should switch on codes rather than on error descriptions, which may change.
+type ErrorCode string
+
+// Codes of the token request endpoint
+const (
+	// The request body or parameters are invalid
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	// The request has no OIDC token
+	CodeMissingCredentials ErrorCode = "missing_credentials"
+	// The OIDC token is malformed, not signed by a trusted key, or missing required claims
+	CodeInvalidToken ErrorCode = "invalid_token"
+	// The OIDC token has expired, is not valid yet, or is too old
+	CodeTokenExpired ErrorCode = "token_expired"
+	// The OIDC token was already used, and is only allowed to be used once
+	CodeTokenReplayed ErrorCode = "token_replayed"
+	// No policy trusts the issuer of the OIDC token
+	CodeNoPolicy ErrorCode = "no_policy"
+	// The OIDC token has no audience the policy accepts
+	CodeAudienceMismatch ErrorCode = "audience_mismatch"
+	// The subject of the OIDC token is not the one the policy accepts
+	CodeSubjectMismatch ErrorCode = "subject_mismatch"
+	// The claims of the OIDC token do not match the ones the policy requires
+	CodeClaimsMismatch ErrorCode = "claims_mismatch"
+	// The condition of the policy is not met
+	CodeConditionNotMet ErrorCode = "condition_not_met"
+	// The requested scopes are not allowed, or are denied by a deny policy
+	CodeScopeDenied ErrorCode = "scope_denied"
+	// No Tailscale OAuth client of the server can grant the requested scopes, although a policy allows them
+	CodeScopeUnavailable ErrorCode = "scope_unavailable"
+	// The requested auth key has tags or properties no policy allows
+	CodeKeyDenied ErrorCode = "key_denied"
+	// The keys of the token's issuer are not loaded yet, the request can be retried later
+	CodeKeysUnavailable ErrorCode = "keys_unavailable"
+	// Tailscale failed to issue an access token
+	CodeUpstreamError ErrorCode = "upstream_error"
+	// Tailscale keeps failing to issue access tokens, so none are requested for a while. The request can be retried later
+	CodeUpstreamUnavailable ErrorCode = "upstream_unavailable"
+	// The server failed to handle the request
+	CodeInternalError ErrorCode = "internal_error"
+	// The request is not authorized. Replaces the codes of 401 and 403 responses, and keys_unavailable, when errors are opaque.
+	CodeUnauthorized ErrorCode = "unauthorized"
+)
+
+// Codes defined by RFC 6749 and RFC 8693, used by the token exchange endpoint along with CodeInvalidRequest
+const (
+	CodeInvalidScope           ErrorCode = "invalid_scope"
+	CodeUnsupportedGrantType   ErrorCode = "unsupported_grant_type"
+	CodeServerError            ErrorCode = "server_error"
+	CodeTemporarilyUnavailable ErrorCode = "temporarily_unavailable"
+)
+
+var errorStatus = map[ErrorCode]int{
+	CodeInvalidRequest:         http.StatusBadRequest,
+	CodeMissingCredentials:     http.StatusUnauthorized,
+	CodeInvalidToken:           http.StatusUnauthorized,
+	CodeTokenExpired:           http.StatusUnauthorized,
+	CodeTokenReplayed:          http.StatusUnauthorized,
+	CodeNoPolicy:               http.StatusUnauthorized,
+	CodeAudienceMismatch:       http.StatusUnauthorized,
+	CodeSubjectMismatch:        http.StatusForbidden,
+	CodeClaimsMismatch:         http.StatusForbidden,
+	CodeConditionNotMet:        http.StatusForbidden,
+	CodeScopeDenied:            http.StatusForbidden,
+	CodeKeyDenied:              http.StatusForbidden,
+	CodeScopeUnavailable:       http.StatusForbidden,
+	CodeKeysUnavailable:        http.StatusServiceUnavailable,
+	CodeUpstreamError:          http.StatusInternalServerError,
+	CodeUpstreamUnavailable:    http.StatusServiceUnavailable,
+	CodeInternalError:          http.StatusInternalServerError,
+	CodeUnauthorized:           http.StatusUnauthorized,
+	CodeInvalidScope:           http.StatusBadRequest,
+	CodeUnsupportedGrantType:   http.StatusBadRequest,
+	CodeServerError:            http.StatusInternalServerError,
+	CodeTemporarilyUnavailable: http.StatusServiceUnavailable,
+}
+
+// Status returns the HTTP status code a failure with the code is answered with
+func (c ErrorCode) Status() int {
+	status, ok := errorStatus[c]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	return status
+}
+
+// Error is a failed request as reported to the client, and the JSON body of every error response
+type Error struct {
+	Code        ErrorCode `json:"error"`
+	Description string    `json:"error_description,omitempty"`
+	// identifies the request in the server log, set when errors are opaque
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return string(e.Code)
+	}
+
+	return string(e.Code) + ": " + e.Description
+}
+
+// Status returns the HTTP status code the error is answered with
+func (e *Error) Status() int {
+	return e.Code.Status()
+}
+
+// opaqueError returns the uniform error an authorization failure is answered with when errors are opaque.
+// Keys that are not loaded are hidden too, as only the issuers a policy trusts have keys to load.
+// The detailed reason is only logged, along with the request ID that the returned error carries.
+func opaqueError(logger *slog.Logger, e *Error, err error) *Error {
+	status := e.Status()
+	if status != http.StatusUnauthorized && status != http.StatusForbidden && e.Code != CodeKeysUnavailable {
+		return e
+	}
+
+	id := newRequestID()
+	if e.Code == CodeKeysUnavailable {
+		logger.Warn("Request not authorized, the keys of the token's issuer are unavailable", "requestId", id, "code", e.Code, "status", status, "reason", e.Description, "error", err)
+	} else {
+		logger.Info("Request not authorized", "requestId", id, "code", e.Code, "reason", e.Description, "error", err)
+	}
+
+	return &Error{Code: CodeUnauthorized, Description: "request not authorized", RequestID: id}
+}
+
+func newRequestID() string {
+	var id [16]byte
+	// never fails
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func writeError(w http.ResponseWriter, logger *slog.Logger, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status())
+
+	err := json.NewEncoder(w).Encode(e)
+	if err != nil {
+		logger.Error("Failed to send error response", "error", err)
+	}
+}
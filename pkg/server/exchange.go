@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Identifiers defined by RFC 8693
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// The successful response of the token exchange endpoint, as defined by RFC 8693
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	// seconds until the access token expires, omitted if unknown
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// the granted scopes, separated by spaces
+	Scope string `json:"scope,omitempty"`
+}
+
+// newTokenExchangeHandler serves RFC 8693 token exchange requests, trading an OIDC token for a Tailscale access token
+func newTokenExchangeHandler(e *exchanger) http.HandlerFunc {
+	logger := e.logger
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Debug("Token exchange request received")
+
+		err := r.ParseForm()
+		if err != nil {
+			logger.Debug("Failed to parse form", "error", err)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "invalid form body"})
+			return
+		}
+
+		// parameters must only be sent in the body
+		form := r.PostForm
+
+		if grantType := form.Get("grant_type"); grantType != GrantTypeTokenExchange {
+			logger.Debug("Unsupported grant type", "grantType", grantType)
+			writeError(w, logger, &Error{Code: CodeUnsupportedGrantType, Description: "grant_type must be " + GrantTypeTokenExchange})
+			return
+		}
+
+		subjectToken := form.Get("subject_token")
+		if subjectToken == "" {
+			logger.Debug("Request missing subject token")
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "missing subject_token"})
+			return
+		}
+
+		subjectTokenType := form.Get("subject_token_type")
+		if subjectTokenType != TokenTypeJWT && subjectTokenType != TokenTypeIDToken {
+			logger.Debug("Unsupported subject token type", "subjectTokenType", subjectTokenType)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "subject_token_type must be " + TokenTypeJWT + " or " + TokenTypeIDToken})
+			return
+		}
+
+		if requested := form.Get("requested_token_type"); requested != "" && requested != TokenTypeAccessToken {
+			logger.Debug("Unsupported requested token type", "requestedTokenType", requested)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "only " + TokenTypeAccessToken + " can be issued"})
+			return
+		}
+
+		// scope is optional in RFC 8693, but there are no default scopes to grant, so RFC 6749 section 3.3 has the request fail with invalid_scope
+		scopes := strings.Fields(form.Get("scope"))
+		if len(scopes) == 0 {
+			logger.Debug("Request missing scopes")
+			writeError(w, logger, &Error{Code: CodeInvalidScope, Description: "missing scope, there are no default scopes"})
+			return
+		}
+
+		logger.Debug("Token exchange request decoded", "scopes", scopes)
+
+		accessToken, _, err := e.exchange(r, subjectToken, scopes)
+		if err != nil {
+			writeError(w, logger, oauthError(e.failure(err)))
+			return
+		}
+
+		resp := TokenExchangeResponse{
+			AccessToken:     accessToken.AccessToken,
+			IssuedTokenType: TokenTypeAccessToken,
+			TokenType:       accessToken.Type(),
+			ExpiresIn:       expiresIn(accessToken),
+			Scope:           grantedScope(accessToken, scopes),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			logger.Error("Failed to send response", "error", err)
+			return
+		}
+
+		logger.Debug("Response sent")
+	}
+}
+
+// oauthError converts the error of a failed exchange to one with an RFC 6749 error code
+func oauthError(e *Error) *Error {
+	code := CodeInvalidRequest
+	switch e.Code {
+	case CodeKeysUnavailable, CodeUpstreamUnavailable:
+		code = CodeTemporarilyUnavailable
+	case CodeUpstreamError, CodeInternalError:
+		code = CodeServerError
+	case CodeScopeDenied, CodeScopeUnavailable, CodeKeyDenied:
+		code = CodeInvalidScope
+	}
+
+	// RFC 8693 answers an invalid or unacceptable subject token with invalid_request
+	return &Error{Code: code, Description: e.Description, RequestID: e.RequestID}
+}
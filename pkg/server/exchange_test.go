@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/jacobmichels/tail-sts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenExchangeHandler(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1", "scope2"},
+		},
+	}
+
+	validForm := func() url.Values {
+		return url.Values{
+			"grant_type":         {GrantTypeTokenExchange},
+			"subject_token":      {generateToken(t, defaultIssuer, defaultSubject)},
+			"subject_token_type": {TokenTypeJWT},
+			"scope":              {"scope1 scope2"},
+		}
+	}
+
+	cases := map[string]struct {
+		form           func() url.Values
+		verif          OIDCTokenVerifier
+		expectedStatus int
+		expectedError  ErrorCode
+	}{
+		"valid exchange": {
+			form:           validForm,
+			expectedStatus: 200,
+		},
+		"id token subject": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("subject_token_type", TokenTypeIDToken)
+				return form
+			},
+			expectedStatus: 200,
+		},
+		"access token requested": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("requested_token_type", TokenTypeAccessToken)
+				return form
+			},
+			expectedStatus: 200,
+		},
+		"wrong grant type": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("grant_type", "client_credentials")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeUnsupportedGrantType,
+		},
+		"missing subject token": {
+			form: func() url.Values {
+				form := validForm()
+				form.Del("subject_token")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidRequest,
+		},
+		"unsupported subject token type": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:saml2")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidRequest,
+		},
+		"unsupported requested token type": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("requested_token_type", TokenTypeIDToken)
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidRequest,
+		},
+		"missing scope": {
+			form: func() url.Values {
+				form := validForm()
+				form.Del("scope")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidScope,
+		},
+		"blank scope": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("scope", "  ")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidScope,
+		},
+		"scope not allowed": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("scope", "scope1 scope3")
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidScope,
+		},
+		"untrusted issuer": {
+			form: func() url.Values {
+				form := validForm()
+				form.Set("subject_token", generateToken(t, "https://other.example.com", defaultSubject))
+				return form
+			},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidRequest,
+		},
+		"invalid subject token": {
+			form:           validForm,
+			verif:          &StaticVerifier{err: jwt.ErrTokenSignatureInvalid},
+			expectedStatus: 400,
+			expectedError:  CodeInvalidRequest,
+		},
+		"issuer keys not loaded": {
+			form:           validForm,
+			verif:          &StaticVerifier{err: fmt.Errorf("%w: connection refused", policy.ErrJWKSUnavailable)},
+			expectedStatus: 503,
+			expectedError:  CodeTemporarilyUnavailable,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			verif := tc.verif
+			if verif == nil {
+				verif = &StaticVerifier{}
+			}
+			handler := NewTokenRequestHandler(log, policies, ts, verif)
+
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(tc.form().Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+			if tc.expectedError != "" {
+				var oauthErr Error
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&oauthErr))
+				assert.Equal(t, tc.expectedError, oauthErr.Code)
+				assert.NotEmpty(t, oauthErr.Description)
+				return
+			}
+
+			var resp TokenExchangeResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, fakeAccessToken, resp.AccessToken)
+			assert.Equal(t, TokenTypeAccessToken, resp.IssuedTokenType)
+			assert.Equal(t, "Bearer", resp.TokenType)
+			assert.InDelta(t, 3600, resp.ExpiresIn, 5)
+			assert.Equal(t, "scope1 scope2", resp.Scope)
+		})
+	}
+}
+
+func TestTokenExchangeHandlerOpaqueErrors(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+		},
+	}
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{}, WithOpaqueErrors())
+
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {generateToken(t, defaultIssuer, defaultSubject)},
+		"subject_token_type": {TokenTypeJWT},
+		"scope":              {"scope2"},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Code, w.Body.String())
+
+	var resp Error
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, CodeInvalidRequest, resp.Code)
+	assert.Equal(t, "request not authorized", resp.Description)
+	assert.NotEmpty(t, resp.RequestID)
+}
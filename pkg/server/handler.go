@@ -1,45 +1,127 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/jacobmichels/tail-sts/pkg/replay"
+	"golang.org/x/oauth2"
 )
 
 type Request struct {
 	Scopes []string
 }
 
-func NewTokenRequestHandler(logger *slog.Logger, policies policy.PolicyList, ts AccessTokenFetcher, verif OIDCTokenVerifier) http.Handler {
+// The response sent when the request accepts application/json
+type Response struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// seconds until the access token expires, omitted if unknown
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// the granted scopes, separated by spaces
+	Scope string `json:"scope"`
+	// the name of the policy that allowed the request
+	Policy string `json:"policy"`
+}
+
+// Configures optional behaviour of the token request handler
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	replay       replay.Store
+	opaqueErrors bool
+	keys         AuthKeyCreator
+	backends     map[string]Backend
+}
+
+// Named Tailscale credentials, referenced by the backend field of policies
+type Backend struct {
+	Fetcher AccessTokenFetcher
+	Keys    AuthKeyCreator
+}
+
+// WithReplayStore sets where the IDs of tokens accepted by single-use policies are remembered.
+// Defaults to an in-memory store.
+func WithReplayStore(store replay.Store) HandlerOption {
+	return func(o *handlerOptions) {
+		o.replay = store
+	}
+}
+
+// WithAuthKeyCreator sets how auth keys are created. Defaults to the Tailscale keys API of the default tailnet.
+func WithAuthKeyCreator(keys AuthKeyCreator) HandlerOption {
+	return func(o *handlerOptions) {
+		o.keys = keys
+	}
+}
+
+// WithBackends sets the named backends that policies can reference.
+// Policies without a backend use the fetcher and auth key creator the handler is created with.
+func WithBackends(backends map[string]Backend) HandlerOption {
+	return func(o *handlerOptions) {
+		o.backends = backends
+	}
+}
+
+// WithOpaqueErrors answers every authorization failure with the same error, so that callers cannot learn which issuers,
+// subjects or scopes are trusted. The detailed reason is logged with a request ID that the error carries.
+func WithOpaqueErrors() HandlerOption {
+	return func(o *handlerOptions) {
+		o.opaqueErrors = true
+	}
+}
+
+func NewTokenRequestHandler(logger *slog.Logger, policies PolicyProvider, ts AccessTokenFetcher, verif OIDCTokenVerifier, opts ...HandlerOption) http.Handler {
+	options := handlerOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.replay == nil {
+		options.replay = replay.NewMemoryStore(replay.DefaultCapacity)
+	}
+
+	if options.keys == nil {
+		options.keys = NewTailscaleKeyCreator(DefaultTailscaleAPIURL, DefaultTailnet)
+	}
+
+	e := &exchanger{
+		logger:         logger,
+		policies:       policies,
+		defaultBackend: Backend{Fetcher: ts, Keys: options.keys},
+		backends:       options.backends,
+		verif:          verif,
+		replay:         options.replay,
+		opaqueErrors:   options.opaqueErrors,
+	}
+
 	mux := http.NewServeMux()
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		logger.Debug("Request received")
 
 		// perform basic validation of the format of the request
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			logger.Debug("Request missing Authorization header")
-			http.Error(w, "missing Authorization header", http.StatusUnauthorized)
-			return
-		}
-
-		if !strings.HasPrefix(auth, "Bearer ") {
-			logger.Debug("Request missing Bearer prefix")
-			http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
+		token, err := bearerToken(r)
+		if err != nil {
+			writeError(w, logger, e.failure(err))
 			return
 		}
 
 		var req Request
-		err := json.NewDecoder(r.Body).Decode(&req)
+		err = json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
 			logger.Debug("Failed to decode request", "error", err)
-			http.Error(w, "invalid request", http.StatusBadRequest)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "invalid request"})
 			return
 		}
 
@@ -47,93 +129,495 @@ func NewTokenRequestHandler(logger *slog.Logger, policies policy.PolicyList, ts
 
 		if len(req.Scopes) == 0 {
 			logger.Debug("Request missing scopes")
-			http.Error(w, "missing scopes", http.StatusBadRequest)
+			writeError(w, logger, &Error{Code: CodeInvalidRequest, Description: "missing scopes"})
 			return
 		}
 
-		// parse the token without validating it
-		// this is needed to read the issuer in order to find a matching policy
-		parser := jwt.NewParser()
-		var claims jwt.RegisteredClaims
-		_, _, err = parser.ParseUnverified(string(auth[7:]), &claims)
+		accessToken, p, err := e.exchange(r, token, req.Scopes)
 		if err != nil {
-			logger.Debug("Failed to parse token", "error", err)
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			writeError(w, logger, e.failure(err))
 			return
 		}
 
-		// find the policy that matches the token's issuer
-		policy := policies.FindByIssuer(claims.Issuer)
-		if policy == nil {
-			logger.Debug("No matching policy", "issuer", claims.Issuer)
-			http.Error(w, "no matching policy", http.StatusUnauthorized)
+		if acceptsJSON(r) {
+			err = writeJSONResponse(w, accessToken, req.Scopes, p.Name)
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, err = w.Write([]byte(accessToken.AccessToken))
+		}
+		if err != nil {
+			logger.Error("Failed to send response", "error", err)
 			return
 		}
 
-		logger.Debug("Matching policy found", "issuer", claims.Issuer, "allowedScopes", policy.AllowedScopes)
+		logger.Debug("Response sent")
+	}
+
+	mux.HandleFunc("POST /", handler)
+	mux.HandleFunc("POST /token", newTokenExchangeHandler(e))
+	mux.HandleFunc("POST /authkey", newAuthKeyHandler(e))
+	return mux
+}
+
+// bearerToken returns the token in the Authorization header of the request
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", errMissingAuthorization
+	}
+
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return "", errInvalidAuthorization
+	}
+
+	return token, nil
+}
+
+// Exchanges OIDC tokens for Tailscale access tokens, for every endpoint of the handler
+type exchanger struct {
+	logger   *slog.Logger
+	policies PolicyProvider
+	// the backend of policies without one
+	defaultBackend Backend
+	backends       map[string]Backend
+	verif          OIDCTokenVerifier
+	replay         replay.Store
+	// answer authorization failures uniformly
+	opaqueErrors bool
+}
+
+// exchange checks the token and the requested scopes against the policies.
+// If a policy allows them, it returns a Tailscale access token and the policy.
+func (e *exchanger) exchange(r *http.Request, token string, scopes []string) (*oauth2.Token, *policy.Policy, error) {
+	p, release, err := e.authorize(r, token, scopes, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessToken, err := e.fetch(r.Context(), p, scopes)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return accessToken, p, nil
+}
+
+// authorize checks the token, the requested scopes and the requested auth key, if any, against the policies.
+// It returns the policy that allows them.
+// A single-use token is used up by a successful authorization. The returned function releases it again,
+// and must be called if no credential is issued, so that a failure of Tailscale does not burn the token.
+func (e *exchanger) authorize(r *http.Request, token string, scopes []string, key *policy.KeyRequest) (*policy.Policy, func(), error) {
+	logger := e.logger
+
+	// parse the token without validating it
+	// this is needed to read the issuer in order to find a matching policy
+	parser := jwt.NewParser()
+	var rawClaims jwt.MapClaims
+	_, _, err := parser.ParseUnverified(token, &rawClaims)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+
+	issuer, err := rawClaims.GetIssuer()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
 
-		// use that policy's JWKS to verify the token
-		err = verif.Verify(string(auth[7:]), policy.Algorithm, policy.Jwks)
+	// find the policies that trust the token's issuer
+	candidates := e.policies.Policies().FilterByIssuer(issuer)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("%w for issuer %s", errNoMatchingPolicy, issuer)
+	}
+
+	logger.Debug("Candidate policies found", "issuer", issuer, "count", len(candidates))
+
+	in := policy.Input{
+		Claims: rawClaims,
+		Scopes: scopes,
+		Request: policy.RequestMetadata{
+			RemoteAddr: r.RemoteAddr,
+			Host:       r.Host,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			UserAgent:  r.UserAgent(),
+		},
+		Key: key,
+	}
+
+	p, err := evaluate(logger, candidates, token, in, e.verif)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !p.SingleUse {
+		return p, func() {}, nil
+	}
+
+	id, err := useOnce(e.replay, issuer, rawClaims, time.Duration(p.Leeway))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release := func() {
+		err := e.replay.Release(id)
 		if err != nil {
-			switch {
-			case errors.Is(err, jwt.ErrTokenMalformed):
-				logger.Debug("Malformed token", "error", err)
-				http.Error(w, "malformed token", http.StatusUnauthorized)
-			case errors.Is(err, jwt.ErrTokenSignatureInvalid):
-				logger.Debug("Invalid signature", "error", err)
-				http.Error(w, "invalid signature", http.StatusUnauthorized)
-			case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet):
-				logger.Debug("Token expired or not yet valid", "error", err)
-				http.Error(w, "token expired or not yet valid", http.StatusUnauthorized)
-			default:
-				logger.Debug("Cannot handle this token", "error", err)
-				http.Error(w, "cannot handle this token", http.StatusUnauthorized)
-			}
+			// the token stays used, which is safe
+			logger.Error("Failed to release single-use token", "policy", p.Name, "error", err)
 			return
 		}
+		logger.Debug("Single-use token released after a failed request", "policy", p.Name)
+	}
 
-		logger.Debug("Token signature validated")
+	return p, release, nil
+}
 
-		if policy.Subject == nil {
-			logger.Debug("No subject specified in policy, allowing any subject")
-		} else if claims.Subject != *policy.Subject {
-			logger.Debug("Subject mismatch", "expected", *policy.Subject, "actual", claims.Subject)
-			http.Error(w, "subject mismatch", http.StatusForbidden)
-			return
+// backend returns the Tailscale credentials of the policy
+func (e *exchanger) backend(p *policy.Policy) (Backend, error) {
+	if p.Backend == "" {
+		return e.defaultBackend, nil
+	}
+
+	backend, ok := e.backends[p.Backend]
+	if !ok {
+		// policies are validated against the configured backends, so this is a server misconfiguration
+		return Backend{}, fmt.Errorf("%w %q of policy %s", errUnknownBackend, p.Backend, p.Name)
+	}
+
+	return backend, nil
+}
+
+// fetch gets a Tailscale access token with the scopes, which the policy has allowed, from the policy's backend
+func (e *exchanger) fetch(ctx context.Context, p *policy.Policy, scopes []string) (*oauth2.Token, error) {
+	backend, err := e.backend(p)
+	if err != nil {
+		return nil, err
+	}
+
+	e.logger.Info("Request allowed, fetching tailscale access token", "policy", p.Name, "backend", p.Backend, "requestedScopes", scopes, "allowedScopes", p.AllowedScopes)
+
+	accessToken, err := backend.Fetcher.Fetch(ctx, scopes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errFetch, err)
+	}
+
+	e.logger.Debug("Access token acquired")
+
+	return accessToken, nil
+}
+
+// acceptsJSON reports whether the Accept header of the request lists application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+
+			// q=0 means not acceptable
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+
+			return true
 		}
+	}
 
-		logger.Debug("Subject validated")
+	return false
+}
 
-		// token is validated and matches a policy
-		// time to evaluate the requested scopes against the policy
-		allowed := policy.Satisfied(req.Scopes)
-		if !allowed {
-			logger.Debug("Request denied", "requestedScopes", req.Scopes, "allowedScopes", policy.AllowedScopes)
-			http.Error(w, "request denied", http.StatusForbidden)
-			return
+func writeJSONResponse(w http.ResponseWriter, token *oauth2.Token, requestedScopes []string, policyName string) error {
+	resp := Response{
+		AccessToken: token.AccessToken,
+		TokenType:   token.Type(),
+		ExpiresIn:   expiresIn(token),
+		Scope:       grantedScope(token, requestedScopes),
+		Policy:      policyName,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// grantedScope returns the scopes granted to the access token, separated by spaces
+func grantedScope(token *oauth2.Token, requestedScopes []string) string {
+	// the token endpoint may grant other scopes than requested, and says so if it does
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		return scope
+	}
+
+	return strings.Join(requestedScopes, " ")
+}
+
+// expiresIn returns the seconds until the access token expires, or 0 if that is unknown
+func expiresIn(token *oauth2.Token) int64 {
+	if token.Expiry.IsZero() {
+		return 0
+	}
+
+	return max(int64(time.Until(token.Expiry).Seconds()), 0)
+}
+
+var (
+	errMissingAuthorization = errors.New("missing Authorization header")
+	errInvalidAuthorization = errors.New("invalid Authorization header")
+	errInvalidToken         = errors.New("invalid token")
+	errFetch                = errors.New("failed to get tailscale token")
+	errUnknownBackend       = errors.New("unknown backend")
+	errNoMatchingPolicy     = errors.New("no matching policy")
+	errScopesDenied         = errors.New("requested scopes not allowed")
+	errMissingJti           = errors.New("token has no jti")
+	errReplayStore          = errors.New("failed to record token use")
+)
+
+// useOnce records the token as used, and fails if it was used before. It returns the ID the use was recorded with.
+// The token is remembered for as long as it is accepted, which is until it expires plus the policy's leeway.
+func useOnce(store replay.Store, issuer string, claims jwt.MapClaims, leeway time.Duration) (string, error) {
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return "", errMissingJti
+	}
+
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return "", err
+	}
+
+	if exp == nil {
+		return "", fmt.Errorf("%w: exp", jwt.ErrTokenRequiredClaimMissing)
+	}
+
+	// token IDs are only unique per issuer
+	id := issuer + " " + jti
+	err = store.Use(id, exp.Add(leeway))
+	if err != nil && !errors.Is(err, replay.ErrReplayed) {
+		return "", fmt.Errorf("%w: %w", errReplayStore, err)
+	}
+
+	return id, err
+}
+
+// evaluate checks the token and the requested scopes against every candidate policy.
+// Any deny policy that matches the token and one of the requested scopes rejects the request,
+// as does a deny policy whose keys are not loaded or whose condition cannot be evaluated.
+// Otherwise access is granted by the first allow policy whose conditions match and that allows every requested scope.
+func evaluate(logger *slog.Logger, candidates policy.PolicyList, token string, in policy.Input, verif OIDCTokenVerifier) (*policy.Policy, error) {
+	// deny policies are evaluated first so that no allow policy can override them
+	for i := range candidates {
+		p := &candidates[i]
+		if !p.IsDeny() {
+			continue
 		}
 
-		logger.Debug("Request allowed, fetching tailscale access token", "requestedScopes", req.Scopes, "allowedScopes", policy.AllowedScopes)
+		denied := p.Denies(in.Scopes)
+		if len(denied) == 0 {
+			continue
+		}
 
-		accessToken, err := ts.Fetch(r.Context(), req.Scopes)
+		err := verif.Verify(token, p)
+		if errors.Is(err, policy.ErrJWKSUnavailable) {
+			// a deny policy that cannot be evaluated fails closed
+			logger.Warn("Deny policy keys are not loaded, denying the request", "policy", p.Name, "deniedScopes", denied, "error", err)
+			return nil, err
+		}
 		if err != nil {
-			logger.Error("Failed to get tailscale token", "error", err)
-			http.Error(w, "failed to get tailscale token", http.StatusInternalServerError)
-			return
+			// any other failure, e.g. a key the policy does not pin or a token older than its max_token_age, means the policy does not apply
+			logger.Debug("Token verification failed, deny policy does not apply", "policy", p.Name, "error", err)
+			continue
 		}
 
-		logger.Debug("Access token acquired")
+		err = p.Match(in)
+		if errors.Is(err, policy.ErrConditionFailed) {
+			// a condition that errors, e.g. on a claim of an unexpected type, must not let the request through
+			logger.Warn("Deny policy condition could not be evaluated, denying the request", "policy", p.Name, "deniedScopes", denied, "error", err)
+			return nil, fmt.Errorf("%w %s: %w", policy.ErrDenied, p.Name, err)
+		}
+		if err != nil {
+			logger.Debug("Deny policy conditions not met", "policy", p.Name, "error", err)
+			continue
+		}
+
+		logger.Info("Request denied by deny policy", "policy", p.Name, "deniedScopes", denied)
+		return nil, fmt.Errorf("%w %s", policy.ErrDenied, p.Name)
+	}
 
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		_, err = w.Write([]byte(accessToken))
+	// when no policy grants access, report the failure that got furthest through evaluation
+	var verifyErr, unavailableErr, conditionErr, keyErr error
+	scopesDenied := false
+
+	for i := range candidates {
+		p := &candidates[i]
+		if p.IsDeny() {
+			continue
+		}
+
+		// use the policy's JWKS to verify the token
+		err := verif.Verify(token, p)
 		if err != nil {
-			logger.Error("Failed to send response", "error", err)
-			return
+			logger.Debug("Token verification failed", "policy", p.Name, "error", err)
+			if errors.Is(err, policy.ErrJWKSUnavailable) {
+				// the token may well be valid, the client should retry once the keys are loaded
+				if unavailableErr == nil {
+					unavailableErr = err
+				}
+			} else if verifyErr == nil {
+				verifyErr = err
+			}
+			continue
 		}
 
-		logger.Debug("Response sent")
+		err = p.Match(in)
+		if err != nil {
+			logger.Debug("Policy conditions not met", "policy", p.Name, "error", err)
+			if conditionErr == nil {
+				conditionErr = err
+			}
+			continue
+		}
+
+		if !p.Satisfied(in.Scopes) {
+			logger.Debug("Policy does not allow requested scopes", "policy", p.Name, "requestedScopes", in.Scopes, "allowedScopes", p.AllowedScopes)
+			scopesDenied = true
+			continue
+		}
+
+		// without a key request, the scopes are for an access token handed to the caller
+		if in.Key != nil {
+			err = p.AllowsKey(*in.Key)
+		} else {
+			err = p.AllowsAccessToken(in.Scopes)
+		}
+		if err != nil {
+			logger.Debug("Policy does not allow requested auth key", "policy", p.Name, "error", err)
+			if keyErr == nil {
+				keyErr = err
+			}
+			continue
+		}
+
+		return p, nil
 	}
 
-	mux.HandleFunc("POST /", handler)
-	return mux
+	switch {
+	case keyErr != nil:
+		return nil, keyErr
+	case scopesDenied:
+		return nil, errScopesDenied
+	case conditionErr != nil:
+		return nil, conditionErr
+	case unavailableErr != nil:
+		return nil, unavailableErr
+	case verifyErr != nil:
+		return nil, verifyErr
+	default:
+		// only deny policies trust the issuer
+		return nil, errNoMatchingPolicy
+	}
+}
+
+// failure returns the error a failed exchange is answered with
+func (e *exchanger) failure(err error) *Error {
+	described := describeError(e.logger, err)
+	if e.opaqueErrors {
+		return opaqueError(e.logger, described, err)
+	}
+
+	return described
+}
+
+// describeError logs why a request failed, and returns the error it is answered with
+func describeError(logger *slog.Logger, err error) *Error {
+	switch {
+	case errors.Is(err, errMissingAuthorization), errors.Is(err, errInvalidAuthorization):
+		logger.Debug("Request without a bearer token", "error", err)
+		return &Error{Code: CodeMissingCredentials, Description: err.Error()}
+	// checked before errFetch, which wraps them
+	case errors.Is(err, ErrNoClientForScopes):
+		logger.Warn("No OAuth client can grant the scopes a policy allowed", "error", err)
+		return &Error{Code: CodeScopeUnavailable, Description: "no Tailscale OAuth client can grant the requested scopes"}
+	case errors.Is(err, ErrCircuitOpen):
+		logger.Warn("Not requesting a tailscale token while the token endpoint is failing", "error", err)
+		return &Error{Code: CodeUpstreamUnavailable, Description: "tailscale is unavailable, retry later"}
+	case errors.Is(err, errFetch):
+		logger.Error("Failed to get tailscale token", "error", err)
+		return &Error{Code: CodeUpstreamError, Description: "failed to get tailscale token"}
+	case errors.Is(err, errUnknownBackend):
+		logger.Error("Policy references an unknown backend", "error", err)
+		return &Error{Code: CodeInternalError, Description: "policy references an unknown backend"}
+	case errors.Is(err, errCreateKey):
+		logger.Error("Failed to create tailscale auth key", "error", err)
+		return &Error{Code: CodeUpstreamError, Description: "failed to create tailscale auth key"}
+	case errors.Is(err, policy.ErrKeyNotAllowed):
+		logger.Debug("Auth key not allowed", "error", err)
+		return &Error{Code: CodeKeyDenied, Description: "auth key not allowed"}
+	case errors.Is(err, errInvalidToken):
+		logger.Debug("Failed to parse token", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "invalid token"}
+	case errors.Is(err, errNoMatchingPolicy):
+		logger.Debug("No matching allow policy", "error", err)
+		return &Error{Code: CodeNoPolicy, Description: "no matching policy"}
+	case errors.Is(err, errReplayStore):
+		logger.Error("Failed to record token use", "error", err)
+		return &Error{Code: CodeInternalError, Description: "failed to record token use"}
+	case errors.Is(err, replay.ErrReplayed):
+		logger.Info("Single-use token presented again", "error", err)
+		return &Error{Code: CodeTokenReplayed, Description: "token already used"}
+	case errors.Is(err, errMissingJti):
+		logger.Debug("Single-use token without jti", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "token missing jti"}
+	case errors.Is(err, policy.ErrDenied):
+		logger.Debug("Request denied", "error", err)
+		return &Error{Code: CodeScopeDenied, Description: "denied by policy"}
+	case errors.Is(err, policy.ErrJWKSUnavailable):
+		logger.Warn("Keys of the token's issuer are not loaded", "error", err)
+		return &Error{Code: CodeKeysUnavailable, Description: "keys of the token's issuer are not loaded yet"}
+	case errors.Is(err, errScopesDenied):
+		logger.Debug("Request denied", "error", err)
+		return &Error{Code: CodeScopeDenied, Description: "request denied"}
+	case errors.Is(err, policy.ErrMissingAudience):
+		logger.Debug("Token missing audience", "error", err)
+		return &Error{Code: CodeAudienceMismatch, Description: "missing audience"}
+	case errors.Is(err, policy.ErrAudienceMismatch):
+		logger.Debug("Audience mismatch", "error", err)
+		return &Error{Code: CodeAudienceMismatch, Description: "audience mismatch"}
+	case errors.Is(err, policy.ErrSubjectMismatch):
+		logger.Debug("Subject mismatch", "error", err)
+		return &Error{Code: CodeSubjectMismatch, Description: "subject mismatch"}
+	case errors.Is(err, policy.ErrClaimMismatch):
+		logger.Debug("Claims mismatch", "error", err)
+		return &Error{Code: CodeClaimsMismatch, Description: "claims mismatch"}
+	case errors.Is(err, policy.ErrConditionNotMet):
+		logger.Debug("Condition not met", "error", err)
+		return &Error{Code: CodeConditionNotMet, Description: "condition not met"}
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		logger.Debug("Malformed token", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "malformed token"}
+	case errors.Is(err, policy.ErrKeyNotPinned):
+		logger.Debug("Token signed by a key not pinned by the policy", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "signing key not trusted"}
+	case errors.Is(err, policy.ErrAlgorithmNotAdvertised):
+		logger.Warn("Token signed with an algorithm its issuer does not advertise", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "signing algorithm not advertised by the issuer"}
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		logger.Debug("Invalid signature", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "invalid signature"}
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		logger.Debug("Token missing required claim", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "token missing required claim"}
+	case errors.Is(err, policy.ErrTokenTooOld):
+		logger.Debug("Token too old", "error", err)
+		return &Error{Code: CodeTokenExpired, Description: "token too old"}
+	case errors.Is(err, policy.ErrTokenLifetimeTooLong):
+		logger.Debug("Token lifetime too long", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "token lifetime too long"}
+	case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) || errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		logger.Debug("Token expired or not yet valid", "error", err)
+		return &Error{Code: CodeTokenExpired, Description: "token expired or not yet valid"}
+	default:
+		logger.Debug("Cannot handle this token", "error", err)
+		return &Error{Code: CodeInvalidToken, Description: "cannot handle this token"}
+	}
 }
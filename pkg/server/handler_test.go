@@ -2,16 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/jacobmichels/tail-sts/pkg/replay"
 	"github.com/jacobmichels/tail-sts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 )
 
 var _ AccessTokenFetcher = (*testutils.StaticFetcher)(nil)
@@ -23,11 +32,23 @@ type StaticVerifier struct {
 
 var _ OIDCTokenVerifier = (*StaticVerifier)(nil)
 
-func (s *StaticVerifier) Verify(token, alg string, kf keyfunc.Keyfunc) error {
+func (s *StaticVerifier) Verify(token string, p *policy.Policy) error {
 	return s.err
 }
 
+// Fails verification for the policies it lists by name, and passes it for every other policy
+type PolicyVerifier struct {
+	errs map[string]error
+}
+
+var _ OIDCTokenVerifier = (*PolicyVerifier)(nil)
+
+func (v *PolicyVerifier) Verify(token string, p *policy.Policy) error {
+	return v.errs[p.Name]
+}
+
 var defaultSubject string = "test-subject"
+var otherSubject string = "other-subject"
 
 const defaultIssuer = "https://example.com"
 const fakeAccessToken = "mock-access-token"
@@ -113,11 +134,432 @@ func TestTokenRequestHandler(t *testing.T) {
 			expectedErrorMessage: "subject mismatch",
 			verif:                &StaticVerifier{err: nil},
 		},
+		"matching audience": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "aud": "tailsts"}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					Audience:      policy.StringList{"tailsts"},
+					AllowedScopes: []string{"scope1", "scope2"},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"mismatched audience": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "aud": []string{"other-service"}}),
+			expectedStatus: 401,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					Audience:      policy.StringList{"tailsts"},
+					AllowedScopes: []string{"scope1", "scope2"},
+				},
+			},
+			expectedErrorMessage: "audience mismatch",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"missing audience": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 401,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					Audience:      policy.StringList{"tailsts"},
+					AllowedScopes: []string{"scope1", "scope2"},
+				},
+			},
+			expectedErrorMessage: "missing audience",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"matching claims": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "repository": "acme/app", "ref": "refs/heads/main"}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "scope2"},
+					Claims: map[string]policy.ClaimMatcher{
+						"repository": {Kind: policy.MatchExact, Values: []string{"acme/app"}},
+						"ref":        {Kind: policy.MatchGlob, Values: []string{"refs/heads/*"}},
+					},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"mismatched claims": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "repository": "acme/app", "ref": "refs/pull/1/merge"}),
+			expectedStatus: 403,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "scope2"},
+					Claims: map[string]policy.ClaimMatcher{
+						"repository": {Kind: policy.MatchExact, Values: []string{"acme/app"}},
+						"ref":        {Kind: policy.MatchGlob, Values: []string{"refs/heads/*"}},
+					},
+				},
+			},
+			expectedErrorMessage: "claims mismatch",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"matching subject pattern": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, "repo:acme/app:ref:refs/heads/main"),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:         "https://example.com",
+					AllowedScopes:  []string{"scope1", "scope2"},
+					SubjectPattern: &policy.Pattern{Kind: policy.MatchGlob, Value: "repo:acme/*:ref:refs/heads/main"},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"mismatched subject pattern": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, "repo:acme/app:ref:refs/heads/dev"),
+			expectedStatus: 403,
+			policies: policy.PolicyList{
+				{
+					Issuer:         "https://example.com",
+					AllowedScopes:  []string{"scope1", "scope2"},
+					SubjectPattern: &policy.Pattern{Kind: policy.MatchGlob, Value: "repo:acme/*:ref:refs/heads/main"},
+				},
+			},
+			expectedErrorMessage: "subject mismatch",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"second policy for the issuer grants access": {
+			requestedScopes: []string{
+				"scope3",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Name:          "first",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "scope2"},
+				},
+				{
+					Name:          "second",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope3"},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"policy with mismatched conditions is skipped": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Name:          "other-subject",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+					Subject:       &otherSubject,
+				},
+				{
+					Name:          "any-subject",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"scopes split across policies are not combined": {
+			requestedScopes: []string{
+				"scope1",
+				"scope3",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 403,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "scope2"},
+				},
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope3"},
+				},
+			},
+			expectedErrorMessage: "request denied",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"condition met": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "environment": "prod", "ref": "refs/heads/main"}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+					Condition:     `claims.environment != "prod" || claims.ref == "refs/heads/main"`,
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"condition not met": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "environment": "prod", "ref": "refs/heads/feature"}),
+			expectedStatus: 403,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+					Condition:     `claims.environment != "prod" || claims.ref == "refs/heads/main"`,
+				},
+			},
+			expectedErrorMessage: "condition not met",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"deny policy overrides allow policy": {
+			requestedScopes: []string{
+				"scope1",
+				"acls",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "event_name": "pull_request_target"}),
+			expectedStatus: 403,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Name:         "no-acls-from-forks",
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+					Claims: map[string]policy.ClaimMatcher{
+						"event_name": {Kind: policy.MatchExact, Values: []string{"pull_request_target"}},
+					},
+				},
+			},
+			expectedErrorMessage: "denied by policy",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"deny policy for other scopes": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "event_name": "pull_request_target"}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"deny policy with unmet conditions": {
+			requestedScopes: []string{
+				"acls",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "event_name": "push"}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+					Claims: map[string]policy.ClaimMatcher{
+						"event_name": {Kind: policy.MatchExact, Values: []string{"pull_request_target"}},
+					},
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"deny policy whose condition cannot be evaluated": {
+			requestedScopes: []string{
+				"acls",
+			},
+			token:                generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "run_attempt": "2"}),
+			expectedStatus:       403,
+			expectedErrorMessage: "denied by policy",
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+					Condition:    `claims.run_attempt > 1`,
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"deny policy whose condition is false": {
+			requestedScopes: []string{
+				"acls",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "run_attempt": 1}),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+					Condition:    `claims.run_attempt > 1`,
+				},
+			},
+			verif: &StaticVerifier{err: nil},
+		},
+		"deny policy the token fails verification for does not apply": {
+			requestedScopes: []string{
+				"acls",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 200,
+			policies: policy.PolicyList{
+				{
+					Name:          "allow",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Name:         "deny",
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+					MaxTokenAge:  policy.Duration(time.Minute),
+				},
+			},
+			verif: &PolicyVerifier{errs: map[string]error{"deny": policy.ErrTokenTooOld}},
+		},
+		"deny policy whose keys are not loaded": {
+			requestedScopes: []string{
+				"acls",
+			},
+			token:                generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus:       503,
+			expectedErrorMessage: "not loaded yet",
+			policies: policy.PolicyList{
+				{
+					Name:          "allow",
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1", "acls"},
+				},
+				{
+					Name:         "deny",
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+				},
+			},
+			verif: &PolicyVerifier{errs: map[string]error{"deny": fmt.Errorf("%w: connection refused", policy.ErrJWKSUnavailable)}},
+		},
+		"only deny policies for the issuer": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 401,
+			policies: policy.PolicyList{
+				{
+					Issuer:       "https://example.com",
+					Effect:       policy.EffectDeny,
+					DeniedScopes: []string{"acls"},
+				},
+			},
+			expectedErrorMessage: "no matching policy",
+			verif:                &StaticVerifier{err: nil},
+		},
+		"token fails verification": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 401,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+				},
+			},
+			expectedErrorMessage: "invalid signature",
+			verif:                &StaticVerifier{err: jwt.ErrTokenSignatureInvalid},
+		},
+		"issuer keys not loaded": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 503,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+				},
+			},
+			expectedErrorMessage: "not loaded yet",
+			verif:                &StaticVerifier{err: fmt.Errorf("%w: connection refused", policy.ErrJWKSUnavailable)},
+		},
+		"single-use token without jti": {
+			requestedScopes: []string{
+				"scope1",
+			},
+			token:          generateTokenWithClaims(t, jwt.MapClaims{"iss": defaultIssuer, "sub": defaultSubject, "exp": time.Now().Add(time.Hour).Unix()}),
+			expectedStatus: 401,
+			policies: policy.PolicyList{
+				{
+					Issuer:        "https://example.com",
+					AllowedScopes: []string{"scope1"},
+					SingleUse:     true,
+				},
+			},
+			expectedErrorMessage: "token missing jti",
+			verif:                &StaticVerifier{err: nil},
+		},
 		"no matching policy": {
 			requestedScopes: []string{
 				"scope1",
 				"scope2",
 			},
+			token:                generateToken(t, defaultIssuer, defaultSubject),
 			expectedStatus:       401,
 			expectedErrorMessage: "no matching policy",
 			policies:             policy.PolicyList{},
@@ -141,6 +583,9 @@ func TestTokenRequestHandler(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
+			for i := range tc.policies {
+				require.NoError(t, tc.policies[i].Compile())
+			}
 			handler := NewTokenRequestHandler(log, tc.policies, ts, tc.verif)
 
 			var body bytes.Buffer
@@ -160,6 +605,16 @@ func TestTokenRequestHandler(t *testing.T) {
 				t.Errorf("expected status %d, got %d. error message: %s", tc.expectedStatus, w.Code, w.Body.String())
 			}
 
+			if tc.expectedErrorMessage != "" && !strings.Contains(w.Body.String(), tc.expectedErrorMessage) {
+				t.Errorf("expected error message %q, got %q", tc.expectedErrorMessage, w.Body.String())
+			}
+
+			if w.Code != 200 {
+				var resp Error
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, w.Code, resp.Code.Status(), "status of error code %q", resp.Code)
+			}
+
 			if w.Code == 200 {
 				token := w.Body.String()
 
@@ -175,13 +630,407 @@ func TestTokenRequestHandler(t *testing.T) {
 	}
 }
 
+func TestDescribeError(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	cases := map[string]struct {
+		err  error
+		code ErrorCode
+	}{
+		"missing authorization":    {err: errMissingAuthorization, code: CodeMissingCredentials},
+		"malformed token":          {err: fmt.Errorf("%w: bad", errInvalidToken), code: CodeInvalidToken},
+		"invalid signature":        {err: jwt.ErrTokenSignatureInvalid, code: CodeInvalidToken},
+		"untrusted key":            {err: policy.ErrKeyNotPinned, code: CodeInvalidToken},
+		"algorithm not advertised": {err: policy.ErrAlgorithmNotAdvertised, code: CodeInvalidToken},
+		"expired":                  {err: jwt.ErrTokenExpired, code: CodeTokenExpired},
+		"too old":                  {err: policy.ErrTokenTooOld, code: CodeTokenExpired},
+		"replayed":                 {err: replay.ErrReplayed, code: CodeTokenReplayed},
+		"no policy":                {err: errNoMatchingPolicy, code: CodeNoPolicy},
+		"missing audience":         {err: policy.ErrMissingAudience, code: CodeAudienceMismatch},
+		"subject mismatch":         {err: policy.ErrSubjectMismatch, code: CodeSubjectMismatch},
+		"claims mismatch":          {err: policy.ErrClaimMismatch, code: CodeClaimsMismatch},
+		"condition not met":        {err: policy.ErrConditionNotMet, code: CodeConditionNotMet},
+		"scopes not allowed":       {err: errScopesDenied, code: CodeScopeDenied},
+		"denied by a deny policy":  {err: fmt.Errorf("%w deny-acls", policy.ErrDenied), code: CodeScopeDenied},
+		"keys not loaded":          {err: policy.ErrJWKSUnavailable, code: CodeKeysUnavailable},
+		"tailscale failure":        {err: fmt.Errorf("%w: timeout", errFetch), code: CodeUpstreamError},
+		"no client for scopes":     {err: fmt.Errorf("%w: %w: acls", errFetch, ErrNoClientForScopes), code: CodeScopeUnavailable},
+		"tailscale unavailable":    {err: fmt.Errorf("%w: %w", errFetch, ErrCircuitOpen), code: CodeUpstreamUnavailable},
+		"replay store failure":     {err: fmt.Errorf("%w: disk full", errReplayStore), code: CodeInternalError},
+		"anything else":            {err: errors.New("unexpected"), code: CodeInvalidToken},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			e := describeError(log, tc.err)
+			assert.Equal(t, tc.code, e.Code)
+			assert.NotEmpty(t, e.Description)
+		})
+	}
+}
+
+func TestTokenRequestHandlerOpaqueErrors(t *testing.T) {
+	var logs bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+			Subject:       &defaultSubject,
+		},
+	}
+
+	cases := map[string]struct {
+		token  string
+		scopes []string
+		verif  OIDCTokenVerifier
+	}{
+		"no matching policy": {
+			token:  generateToken(t, "https://other.example.com", defaultSubject),
+			scopes: []string{"scope1"},
+		},
+		"mismatched subject": {
+			token:  generateToken(t, defaultIssuer, otherSubject),
+			scopes: []string{"scope1"},
+		},
+		"scopes not allowed": {
+			token:  generateToken(t, defaultIssuer, defaultSubject),
+			scopes: []string{"scope2"},
+		},
+		"invalid signature": {
+			token:  generateToken(t, defaultIssuer, defaultSubject),
+			scopes: []string{"scope1"},
+			verif:  &StaticVerifier{err: jwt.ErrTokenSignatureInvalid},
+		},
+		"keys of a trusted issuer not loaded": {
+			token:  generateToken(t, defaultIssuer, defaultSubject),
+			scopes: []string{"scope1"},
+			verif:  &StaticVerifier{err: fmt.Errorf("%w: connection refused", policy.ErrJWKSUnavailable)},
+		},
+	}
+
+	requestIDs := make(map[string]bool)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			verif := tc.verif
+			if verif == nil {
+				verif = &StaticVerifier{}
+			}
+			handler := NewTokenRequestHandler(log, policies, ts, verif, WithOpaqueErrors())
+
+			body, err := json.Marshal(Request{Scopes: tc.scopes})
+			require.NoError(t, err)
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, 401, w.Code, w.Body.String())
+
+			var resp Error
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, CodeUnauthorized, resp.Code)
+			assert.Equal(t, "request not authorized", resp.Description)
+			require.NotEmpty(t, resp.RequestID)
+			assert.False(t, requestIDs[resp.RequestID], "request ID reused")
+			requestIDs[resp.RequestID] = true
+
+			// the detailed reason is only in the log
+			assert.Contains(t, logs.String(), "requestId="+resp.RequestID)
+		})
+	}
+
+	// requests without a bearer token are not authorized either, on every endpoint that takes one
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{}, WithOpaqueErrors())
+	for _, path := range []string{"/", "/authkey"} {
+		for _, auth := range []string{"", "Basic dXNlcjpwYXNz"} {
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{"scopes":["scope1"]}`))
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, 401, w.Code, w.Body.String())
+
+			var resp Error
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, CodeUnauthorized, resp.Code, path)
+			assert.NotEmpty(t, resp.RequestID, path)
+		}
+	}
+
+	// failures that reveal nothing about the policies are not hidden
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":[]}`))
+	req.Header.Set("Authorization", "Bearer "+generateToken(t, defaultIssuer, defaultSubject))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "missing scopes")
+}
+
+func TestTokenRequestHandlerResponseFormat(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Name:          "ci",
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1", "scope2"},
+		},
+	}
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{})
+
+	cases := map[string]struct {
+		accept string
+		json   bool
+	}{
+		"no Accept header":        {},
+		"plaintext":               {accept: "text/plain"},
+		"any":                     {accept: "*/*"},
+		"json":                    {accept: "application/json", json: true},
+		"json among other types":  {accept: "text/html, application/json;q=0.9", json: true},
+		"json not acceptable":     {accept: "text/plain, application/json;q=0"},
+		"json with charset param": {accept: "application/json; charset=utf-8", json: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1","scope2"]}`))
+			req.Header.Set("Authorization", "Bearer "+generateToken(t, defaultIssuer, defaultSubject))
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code, w.Body.String())
+
+			if !tc.json {
+				assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Equal(t, fakeAccessToken, w.Body.String())
+				return
+			}
+
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var resp Response
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, fakeAccessToken, resp.AccessToken)
+			assert.Equal(t, "Bearer", resp.TokenType)
+			assert.InDelta(t, 3600, resp.ExpiresIn, 5)
+			assert.Equal(t, "scope1 scope2", resp.Scope)
+			assert.Equal(t, "ci", resp.Policy)
+		})
+	}
+}
+
+func TestTokenRequestHandlerBackends(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	policies := policy.PolicyList{
+		{
+			Name:          "default",
+			Issuer:        "https://example.com",
+			Subject:       &defaultSubject,
+			AllowedScopes: []string{"scope1"},
+		},
+		{
+			Name:          "prod",
+			Issuer:        "https://example.com",
+			Subject:       &otherSubject,
+			AllowedScopes: []string{"scope1"},
+			Backend:       "prod",
+		},
+		{
+			Name:          "missing",
+			Issuer:        "https://other.example.com",
+			AllowedScopes: []string{"scope1"},
+			Backend:       "missing",
+		},
+	}
+	backends := map[string]Backend{
+		"prod": {Fetcher: &testutils.StaticFetcher{AccessToken: "prod-access-token"}},
+	}
+	handler := NewTokenRequestHandler(log, policies, &testutils.StaticFetcher{AccessToken: fakeAccessToken}, &StaticVerifier{}, WithBackends(backends))
+
+	cases := map[string]struct {
+		token          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		"policy without a backend": {
+			token:          generateToken(t, defaultIssuer, defaultSubject),
+			expectedStatus: 200,
+			expectedBody:   fakeAccessToken,
+		},
+		"policy with a backend": {
+			token:          generateToken(t, defaultIssuer, otherSubject),
+			expectedStatus: 200,
+			expectedBody:   "prod-access-token",
+		},
+		"policy with an unknown backend": {
+			token:          generateToken(t, "https://other.example.com", defaultSubject),
+			expectedStatus: 500,
+			expectedBody:   "unknown backend",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1"]}`))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tc.expectedBody)
+		})
+	}
+}
+
+func TestTokenRequestHandlerSingleUse(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+			SingleUse:     true,
+		},
+	}
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{}, WithReplayStore(replay.NewMemoryStore(10)))
+
+	request := func(jti string) *httptest.ResponseRecorder {
+		token := generateTokenWithClaims(t, jwt.MapClaims{
+			"iss": defaultIssuer,
+			"sub": defaultSubject,
+			"jti": jti,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1"]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("token-1")
+	if w.Code != 200 {
+		t.Fatalf("expected status 200 for the first use, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("token-1")
+	if w.Code != 401 || !strings.Contains(w.Body.String(), "token already used") {
+		t.Fatalf("expected status 401 for the second use, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("token-2")
+	if w.Code != 200 {
+		t.Fatalf("expected status 200 for another token, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// A single-use token that has expired but is still accepted within the policy's leeway cannot be replayed
+func TestTokenRequestHandlerSingleUseLeeway(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ts := &testutils.StaticFetcher{AccessToken: fakeAccessToken}
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+			SingleUse:     true,
+			Leeway:        policy.Duration(time.Minute),
+		},
+	}
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{}, WithReplayStore(replay.NewMemoryStore(10)))
+
+	token := generateTokenWithClaims(t, jwt.MapClaims{
+		"iss": defaultIssuer,
+		"sub": defaultSubject,
+		"jti": "token-1",
+		"exp": time.Now().Add(-10 * time.Second).Unix(),
+	})
+
+	codes := []int{}
+	for range 2 {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1"]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+
+	assert.Equal(t, []int{200, 401}, codes)
+}
+
+// An AccessTokenFetcher that fails until it is told to succeed
+type unreliableFetcher struct {
+	mu   sync.Mutex
+	fail bool
+}
+
+func (f *unreliableFetcher) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		return nil, fmt.Errorf("%w: 500 Internal Server Error", ErrCircuitOpen)
+	}
+	return &oauth2.Token{AccessToken: fakeAccessToken, TokenType: "Bearer"}, nil
+}
+
+// A single-use token is only used up once a credential is issued for it
+func TestTokenRequestHandlerSingleUseUpstreamFailure(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+			SingleUse:     true,
+		},
+	}
+	ts := &unreliableFetcher{fail: true}
+	handler := NewTokenRequestHandler(log, policies, ts, &StaticVerifier{}, WithReplayStore(replay.NewMemoryStore(10)))
+
+	token := generateTokenWithClaims(t, jwt.MapClaims{
+		"iss": defaultIssuer,
+		"sub": defaultSubject,
+		"jti": "token-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	request := func() int {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1"]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 503, request())
+	assert.Equal(t, 503, request())
+
+	ts.mu.Lock()
+	ts.fail = false
+	ts.mu.Unlock()
+
+	assert.Equal(t, 200, request())
+	assert.Equal(t, 401, request())
+}
+
 func generateToken(t *testing.T, issuer, sub string) string {
 	t.Helper()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return generateTokenWithClaims(t, jwt.MapClaims{
 		"iss": issuer,
 		"sub": sub,
 	})
+}
+
+func generateTokenWithClaims(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	signed, err := token.SignedString([]byte("secret"))
 	if err != nil {
@@ -1,15 +1,22 @@
 package server
 
 import (
-	"github.com/MicahParks/keyfunc/v3"
+	"time"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/policy"
 )
 
 type JWKSVerifier struct{}
 
 var _ OIDCTokenVerifier = (*JWKSVerifier)(nil)
 
-func (v JWKSVerifier) Verify(token, alg string, kf keyfunc.Keyfunc) error {
-	_, err := jwt.Parse(string(token), kf.Keyfunc, jwt.WithValidMethods([]string{alg}))
-	return err
+func (v JWKSVerifier) Verify(token string, p *policy.Policy) error {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(string(token), claims, p.Keyfunc, p.ParserOptions()...)
+	if err != nil {
+		return err
+	}
+
+	return p.ValidateTokenTimes(claims, time.Now())
 }
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWKSVerifierAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		method  jwt.SigningMethod
+		key     crypto.Signer
+		algs    []string
+		isValid bool
+	}{
+		"RS256": {
+			method:  jwt.SigningMethodRS256,
+			key:     rsaKey,
+			algs:    []string{"RS256"},
+			isValid: true,
+		},
+		"PS256": {
+			method:  jwt.SigningMethodPS256,
+			key:     rsaKey,
+			algs:    []string{"PS256"},
+			isValid: true,
+		},
+		"ES256": {
+			method:  jwt.SigningMethodES256,
+			key:     ecKey,
+			algs:    []string{"ES256"},
+			isValid: true,
+		},
+		"ES384": {
+			method:  jwt.SigningMethodES384,
+			key:     ec384Key,
+			algs:    []string{"ES384"},
+			isValid: true,
+		},
+		"EdDSA": {
+			method:  jwt.SigningMethodEdDSA,
+			key:     edKey,
+			algs:    []string{"EdDSA"},
+			isValid: true,
+		},
+		"one of several allowed algorithms": {
+			method:  jwt.SigningMethodES256,
+			key:     ecKey,
+			algs:    []string{"RS256", "ES256"},
+			isValid: true,
+		},
+		"algorithm not allowed by the policy": {
+			method:  jwt.SigningMethodES256,
+			key:     ecKey,
+			algs:    []string{"RS256"},
+			isValid: false,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			kf := keyfuncFromKeys(t, tc.key.Public())
+
+			token := jwt.NewWithClaims(tc.method, jwt.MapClaims{"iss": defaultIssuer, "exp": time.Now().Add(time.Hour).Unix()})
+			token.Header["kid"] = "key-0"
+			signed, err := token.SignedString(tc.key)
+			require.NoError(t, err)
+
+			err = JWKSVerifier{}.Verify(signed, &policy.Policy{Algorithms: tc.algs, Jwks: kf})
+			if tc.isValid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestJWKSVerifierRejectsHMAC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	kf := keyfuncFromKeys(t, rsaKey.Public())
+
+	// an HMAC token signed with the public key as the secret, the classic algorithm confusion attack
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": defaultIssuer, "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "key-0"
+	signed, err := token.SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	err = JWKSVerifier{}.Verify(signed, &policy.Policy{Algorithms: policy.StringList{"RS256", "HS256"}, Jwks: kf})
+	require.Error(t, err)
+}
+
+func TestJWKSVerifierPinnedKeys(t *testing.T) {
+	pinnedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &policy.Policy{
+		Algorithms:  policy.StringList{"RS256"},
+		AllowedKids: policy.StringList{"key-0"},
+		Jwks:        keyfuncFromKeys(t, pinnedKey.Public(), otherKey.Public()),
+	}
+
+	sign := func(key *rsa.PrivateKey, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": defaultIssuer, "exp": time.Now().Add(time.Hour).Unix()})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	require.NoError(t, JWKSVerifier{}.Verify(sign(pinnedKey, "key-0"), p))
+	require.ErrorIs(t, JWKSVerifier{}.Verify(sign(otherKey, "key-1"), p), policy.ErrKeyNotPinned)
+}
+
+func TestJWKSVerifierTokenTimes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	kf := keyfuncFromKeys(t, rsaKey.Public())
+	now := time.Now()
+	noExp := false
+
+	cases := map[string]struct {
+		claims jwt.MapClaims
+		policy policy.Policy
+		err    error
+	}{
+		"exp required by default": {
+			claims: jwt.MapClaims{"iss": defaultIssuer},
+			err:    jwt.ErrTokenRequiredClaimMissing,
+		},
+		"exp not required": {
+			claims: jwt.MapClaims{"iss": defaultIssuer},
+			policy: policy.Policy{RequireExp: &noExp},
+		},
+		"expired": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "exp": now.Add(-time.Minute).Unix()},
+			err:    jwt.ErrTokenExpired,
+		},
+		"expired within leeway": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "exp": now.Add(-time.Minute).Unix()},
+			policy: policy.Policy{Leeway: policy.Duration(2 * time.Minute)},
+		},
+		"iat required": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "exp": now.Add(time.Hour).Unix()},
+			policy: policy.Policy{RequireIat: true},
+			err:    jwt.ErrTokenRequiredClaimMissing,
+		},
+		"issued in the future": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "iat": now.Add(time.Hour).Unix(), "exp": now.Add(2 * time.Hour).Unix()},
+			policy: policy.Policy{RequireIat: true},
+			err:    jwt.ErrTokenUsedBeforeIssued,
+		},
+		"young enough": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "iat": now.Add(-5 * time.Minute).Unix(), "exp": now.Add(time.Hour).Unix()},
+			policy: policy.Policy{MaxTokenAge: policy.Duration(10 * time.Minute)},
+		},
+		"too old": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "iat": now.Add(-time.Hour).Unix(), "exp": now.Add(time.Hour).Unix()},
+			policy: policy.Policy{MaxTokenAge: policy.Duration(10 * time.Minute)},
+			err:    policy.ErrTokenTooOld,
+		},
+		"lifetime too long": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "iat": now.Unix(), "exp": now.Add(24 * time.Hour).Unix()},
+			policy: policy.Policy{MaxTokenLifetime: policy.Duration(time.Hour)},
+			err:    policy.ErrTokenLifetimeTooLong,
+		},
+		"lifetime within limit": {
+			claims: jwt.MapClaims{"iss": defaultIssuer, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()},
+			policy: policy.Policy{MaxTokenLifetime: policy.Duration(time.Hour)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, tc.claims)
+			token.Header["kid"] = "key-0"
+			signed, err := token.SignedString(rsaKey)
+			require.NoError(t, err)
+
+			p := tc.policy
+			p.Algorithms = policy.StringList{"RS256"}
+			p.Jwks = kf
+
+			err = JWKSVerifier{}.Verify(signed, &p)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// keyfuncFromKeys builds a Keyfunc over the public keys, with key IDs key-0, key-1, ...
+func keyfuncFromKeys(t *testing.T, keys ...crypto.PublicKey) keyfunc.Keyfunc {
+	t.Helper()
+
+	var set jwkset.JWKSMarshal
+	for i, key := range keys {
+		jwk, err := jwkset.NewJWKFromKey(key, jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{
+			KID: fmt.Sprintf("key-%d", i),
+		}})
+		require.NoError(t, err)
+		set.Keys = append(set.Keys, jwk.Marshal())
+	}
+
+	raw, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	kf, err := keyfunc.NewJWKSetJSON(raw)
+	require.NoError(t, err)
+
+	return kf
+}
@@ -2,32 +2,160 @@ package server
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
 )
 
+// How long before it expires a cached access token stops being handed out,
+// so that callers have time to use it
+const DefaultTokenExpiryMargin = time.Minute
+
+// How long a fetch shared by several requests may take, as it is not canceled with the request that started it
+const tokenFetchTimeout = 30 * time.Second
+
+// An AccessTokenFetcher that fetches access tokens from a Tailscale OAuth client.
+// Tokens are cached by the set of scopes they were fetched for until shortly before they expire,
+// and concurrent fetches of the same scopes share one call to the token endpoint.
+// It is safe for concurrent use. The returned tokens are shared, and must not be modified.
 type OAuthFetcher struct {
-	config clientcredentials.Config
+	// fetches the tokens that are not cached
+	source AccessTokenFetcher
+	margin time.Duration
+	now    func() time.Time
+
+	group singleflight.Group
+
+	mu sync.Mutex
+	// tokens by normalized scopes
+	cache map[string]*oauth2.Token
 }
 
 var _ AccessTokenFetcher = (*OAuthFetcher)(nil)
 
-func NewOAuthFetcher(clientID, clientSecret, tokenURL string) *OAuthFetcher {
-	return &OAuthFetcher{
-		config: clientcredentials.Config{
-			ClientID:     clientID,
-			ClientSecret: clientSecret,
-			TokenURL:     tokenURL,
+type OAuthFetcherOption func(*OAuthFetcher)
+
+// WithResilience retries failed calls to the token endpoint, and stops calling it for a while when it keeps failing.
+// Cached tokens are still handed out meanwhile.
+func WithResilience(config ResilienceConfig) OAuthFetcherOption {
+	return func(f *OAuthFetcher) {
+		f.source = NewResilientFetcher(f.source, config)
+	}
+}
+
+func NewOAuthFetcher(clientID, clientSecret, tokenURL string, opts ...OAuthFetcherOption) *OAuthFetcher {
+	f := &OAuthFetcher{
+		source: clientCredentials{
+			config: clientcredentials.Config{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				TokenURL:     tokenURL,
+				// as documented by Tailscale. Probing the style would send two requests for every failed attempt
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
 		},
+		margin: DefaultTokenExpiryMargin,
+		now:    time.Now,
+		cache:  make(map[string]*oauth2.Token),
 	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
 }
 
-func (c *OAuthFetcher) Fetch(ctx context.Context, scopes []string) (string, error) {
-	c.config.Scopes = scopes
-	token, err := c.config.Token(ctx)
-	if err != nil {
-		return "", err
+func (c *OAuthFetcher) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	key := scopeKey(scopes)
+	if token, ok := c.cached(key); ok {
+		return token, nil
 	}
 
-	return token.AccessToken, nil
+	result := c.group.DoChan(key, func() (any, error) {
+		// another fetch of the same scopes may have finished since the cache was checked
+		if token, ok := c.cached(key); ok {
+			return token, nil
+		}
+
+		// the fetch is shared, so it outlives the request that started it
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenFetchTimeout)
+		defer cancel()
+
+		token, err := c.source.Fetch(fetchCtx, scopes)
+		if err != nil {
+			return nil, err
+		}
+
+		c.store(key, token)
+		return token, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*oauth2.Token), nil
+	}
+}
+
+// cached returns the cached token for the scopes, unless it is about to expire
+func (c *OAuthFetcher) cached(key string) (*oauth2.Token, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token, ok := c.cache[key]
+	if !ok || !c.fresh(token) {
+		return nil, false
+	}
+
+	return token, true
+}
+
+func (c *OAuthFetcher) store(key string, token *oauth2.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// drop the tokens that can no longer be handed out, so that the cache only holds scopes still in use
+	for k, cached := range c.cache {
+		if !c.fresh(cached) {
+			delete(c.cache, k)
+		}
+	}
+
+	if c.fresh(token) {
+		c.cache[key] = token
+	}
+}
+
+// fresh reports whether a token may be handed out. Tokens without an expiry are never cached.
+func (c *OAuthFetcher) fresh(token *oauth2.Token) bool {
+	return !token.Expiry.IsZero() && c.now().Add(c.margin).Before(token.Expiry)
+}
+
+// scopeKey normalizes scopes, so that requests for the same set of scopes share a token
+func scopeKey(scopes []string) string {
+	normalized := slices.Clone(scopes)
+	slices.Sort(normalized)
+	return strings.Join(slices.Compact(normalized), " ")
+}
+
+// Fetches every access token from the token endpoint, with the client credentials grant
+type clientCredentials struct {
+	config clientcredentials.Config
+}
+
+func (c clientCredentials) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	// a copy for every call, so that concurrent fetches do not share the scopes
+	config := c.config
+	config.Scopes = slices.Clone(scopes)
+	return config.Token(ctx)
 }
@@ -6,9 +6,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Ensuring that OAuthFetcher reaches out to a token endpoint with the expected parameters
@@ -36,5 +40,167 @@ func TestFetchAccessToken(t *testing.T) {
 	c := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL)
 	actualToken, err := c.Fetch(ctx, scopes)
 	assert.NoError(err)
-	assert.Equal(expectedToken, actualToken)
+	assert.Equal(expectedToken, actualToken.AccessToken)
+	assert.WithinDuration(time.Now().Add(time.Hour), actualToken.Expiry, time.Minute)
+}
+
+// tokenEndpoint serves a token endpoint, counting the tokens it issues
+type tokenEndpoint struct {
+	requests  atomic.Int32
+	expiresIn int
+	// blocks every request until closed, if set
+	release chan struct{}
+	// fails this many requests before issuing tokens
+	failures atomic.Int32
+}
+
+func (e *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := e.requests.Add(1)
+	if e.release != nil {
+		<-e.release
+	}
+
+	if e.failures.Add(-1) >= 0 {
+		http.Error(w, `{"error":"server_error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"access_token": "token-%d %s", "token_type": "bearer", "expires_in": %d}`, n, r.PostForm.Get("scope"), e.expiresIn)
+}
+
+func TestOAuthFetcherCache(t *testing.T) {
+	ctx := context.Background()
+	endpoint := &tokenEndpoint{expiresIn: 3600}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	c := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL)
+
+	first, err := c.Fetch(ctx, []string{"devices:read", "acls"})
+	require.NoError(t, err)
+
+	// the same set of scopes, in another order and with duplicates
+	second, err := c.Fetch(ctx, []string{"acls", "devices:read", "acls"})
+	require.NoError(t, err)
+	assert.Equal(t, first.AccessToken, second.AccessToken)
+	assert.Equal(t, int32(1), endpoint.requests.Load())
+
+	other, err := c.Fetch(ctx, []string{"acls"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.AccessToken, other.AccessToken)
+	assert.Equal(t, int32(2), endpoint.requests.Load())
+
+	// the cached token is not handed out within the margin of its expiry
+	c.now = func() time.Time { return time.Now().Add(time.Hour - DefaultTokenExpiryMargin) }
+	renewed, err := c.Fetch(ctx, []string{"devices:read", "acls"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.AccessToken, renewed.AccessToken)
+	assert.Equal(t, int32(3), endpoint.requests.Load())
+}
+
+func TestOAuthFetcherDoesNotCache(t *testing.T) {
+	ctx := context.Background()
+	cases := map[string]struct {
+		expiresIn int
+		failures  int32
+	}{
+		"token expiring within the margin": {expiresIn: 30},
+		"token without expiry":             {expiresIn: 0},
+		"failure":                          {expiresIn: 3600, failures: 1},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			endpoint := &tokenEndpoint{expiresIn: tc.expiresIn}
+			endpoint.failures.Store(tc.failures)
+			srv := httptest.NewServer(endpoint)
+			defer srv.Close()
+
+			c := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL)
+			_, _ = c.Fetch(ctx, []string{"acls"})
+			_, err := c.Fetch(ctx, []string{"acls"})
+			require.NoError(t, err)
+			assert.Equal(t, int32(2), endpoint.requests.Load())
+		})
+	}
+}
+
+// Many concurrent requests for the same scopes, like a CI matrix, cause a single call to the token endpoint
+func TestOAuthFetcherCoalescesConcurrentFetches(t *testing.T) {
+	ctx := context.Background()
+	endpoint := &tokenEndpoint{expiresIn: 3600, release: make(chan struct{})}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	c := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL)
+
+	scopeSets := [][]string{{"acls"}, {"devices:read", "acls"}, {"acls", "devices:read"}}
+	tokens := make([]string, 200)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := c.Fetch(ctx, scopeSets[i%len(scopeSets)])
+			assert.NoError(t, err)
+			if token != nil {
+				tokens[i] = token.AccessToken
+			}
+		}()
+	}
+
+	// fetches that start after the shared one finished are served from the cache
+	require.Eventually(t, func() bool { return endpoint.requests.Load() == 2 }, 5*time.Second, time.Millisecond)
+	close(endpoint.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), endpoint.requests.Load())
+	// every request for a set of scopes got the same token
+	byScopes := map[string]string{}
+	for i, token := range tokens {
+		key := scopeKey(scopeSets[i%len(scopeSets)])
+		if _, ok := byScopes[key]; !ok {
+			byScopes[key] = token
+		}
+		assert.Equal(t, byScopes[key], token)
+	}
+	assert.Len(t, byScopes, 2)
+	assert.NotEqual(t, byScopes["acls"], byScopes["acls devices:read"])
+}
+
+// A request that gives up does not cancel the fetch other requests are waiting for
+func TestOAuthFetcherCanceledCaller(t *testing.T) {
+	endpoint := &tokenEndpoint{expiresIn: 3600, release: make(chan struct{})}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	c := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := c.Fetch(ctx, []string{"acls"})
+		canceled <- err
+	}()
+	require.Eventually(t, func() bool { return endpoint.requests.Load() == 1 }, 5*time.Second, time.Millisecond)
+
+	waiting := make(chan error)
+	go func() {
+		_, err := c.Fetch(context.Background(), []string{"acls"})
+		waiting <- err
+	}()
+
+	cancel()
+	require.ErrorIs(t, <-canceled, context.Canceled)
+
+	close(endpoint.release)
+	require.NoError(t, <-waiting)
+	assert.Equal(t, int32(1), endpoint.requests.Load())
 }
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrCircuitOpen is returned without calling the token endpoint while it is considered down
+var ErrCircuitOpen = errors.New("tailscale token endpoint is unavailable, not retrying until the cooldown ends")
+
+// Settings of a ResilientFetcher
+type ResilienceConfig struct {
+	// How many times a fetch is attempted, including the first attempt. 1 disables retries
+	MaxAttempts int
+	// The delay before the first retry, doubled on every further retry
+	BaseBackoff time.Duration
+	// The longest delay between attempts
+	MaxBackoff time.Duration
+	// The longest Retry-After of a 429 response that is waited for. Longer ones fail the fetch
+	MaxRetryAfter time.Duration
+	// How many fetches in a row must fail for the circuit to open. 0 disables the circuit breaker
+	FailureThreshold int
+	// How long the circuit stays open before a fetch is let through to probe the token endpoint
+	Cooldown time.Duration
+}
+
+// DefaultResilienceConfig returns the settings used unless configured otherwise
+func DefaultResilienceConfig() ResilienceConfig {
+	return ResilienceConfig{
+		MaxAttempts:      3,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		MaxRetryAfter:    10 * time.Second,
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// An AccessTokenFetcher that retries the fetches of another one on transient failures,
+// and stops calling it for a while once fetches keep failing.
+//
+// Server errors and network errors are retried with jittered exponential backoff, and 429 responses after their Retry-After.
+// Other failures, such as invalid credentials, are returned right away.
+type ResilientFetcher struct {
+	next   AccessTokenFetcher
+	config ResilienceConfig
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+
+	mu sync.Mutex
+	// fetches that failed in a row
+	failures  int
+	openUntil time.Time
+	// whether a fetch is probing the token endpoint after the cooldown
+	probing bool
+}
+
+var _ AccessTokenFetcher = (*ResilientFetcher)(nil)
+
+func NewResilientFetcher(next AccessTokenFetcher, config ResilienceConfig) *ResilientFetcher {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+
+	return &ResilientFetcher{
+		next:   next,
+		config: config,
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+func (f *ResilientFetcher) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	err := f.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	var token *oauth2.Token
+	for attempt := 1; ; attempt++ {
+		token, err = f.next.Fetch(ctx, scopes)
+		if err == nil || attempt == f.config.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+
+		delay, retry := f.retryDelay(err, attempt)
+		if !retry {
+			break
+		}
+
+		if sleepErr := f.sleep(ctx, delay); sleepErr != nil {
+			break
+		}
+	}
+
+	f.record(ctx, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// allow fails while the circuit is open. Once the cooldown ends, a single fetch is let through to probe the token endpoint.
+func (f *ResilientFetcher) allow() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.openUntil.IsZero() {
+		return nil
+	}
+
+	if f.now().Before(f.openUntil) || f.probing {
+		return ErrCircuitOpen
+	}
+
+	f.probing = true
+	return nil
+}
+
+// record updates the circuit with the outcome of a fetch. Only failures of the token endpoint count against it.
+func (f *ResilientFetcher) record(ctx context.Context, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	probe := f.probing
+	f.probing = false
+
+	switch {
+	case err == nil || !transient(err):
+		// the token endpoint answered
+		f.failures = 0
+		f.openUntil = time.Time{}
+	case ctx.Err() != nil:
+		// the caller gave up, which says nothing about the token endpoint
+	default:
+		f.failures++
+		if f.config.FailureThreshold > 0 && (probe || f.failures >= f.config.FailureThreshold) {
+			f.openUntil = f.now().Add(f.config.Cooldown)
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a failed attempt, and whether to retry at all
+func (f *ResilientFetcher) retryDelay(err error, attempt int) (time.Duration, bool) {
+	if !transient(err) {
+		return 0, false
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := retryAfter(retrieveErr.Response.Header.Get("Retry-After"), f.now()); ok {
+			return delay, delay <= f.config.MaxRetryAfter
+		}
+	}
+
+	return f.backoff(attempt), true
+}
+
+// backoff returns a random delay between half and all of the exponential backoff of the attempt
+func (f *ResilientFetcher) backoff(attempt int) time.Duration {
+	delay := f.config.BaseBackoff
+	for range attempt - 1 {
+		if delay >= f.config.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	delay = min(delay, f.config.MaxBackoff)
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// transient reports whether a failure is one of the token endpoint that a later attempt may not have:
+// a network error, a server error or a 429
+func transient(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response == nil {
+			return false
+		}
+		status := retrieveErr.Response.StatusCode
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("retry canceled: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A response of a flaky token endpoint
+type flakyResponse struct {
+	status     int
+	retryAfter string
+	// closes the connection without answering
+	drop bool
+}
+
+// flakyTokenEndpoint answers with its scripted responses in order, then issues tokens
+type flakyTokenEndpoint struct {
+	mu       sync.Mutex
+	script   []flakyResponse
+	requests int
+}
+
+func (e *flakyTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	e.requests++
+	var resp *flakyResponse
+	if len(e.script) > 0 {
+		resp = &e.script[0]
+		e.script = e.script[1:]
+	}
+	e.mu.Unlock()
+
+	switch {
+	case resp == nil:
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "testToken", "token_type": "bearer", "expires_in": 3600}`))
+	case resp.drop:
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	default:
+		if resp.retryAfter != "" {
+			w.Header().Set("Retry-After", resp.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		_, _ = w.Write([]byte(`{"error": "server_error"}`))
+	}
+}
+
+func (e *flakyTokenEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+// newFlakyFetcher returns a ResilientFetcher calling the endpoint, which records its delays instead of sleeping
+func newFlakyFetcher(t *testing.T, endpoint *flakyTokenEndpoint, config ResilienceConfig) (*ResilientFetcher, *[]time.Duration) {
+	srv := httptest.NewServer(endpoint)
+	t.Cleanup(srv.Close)
+
+	source := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL).source
+	f := NewResilientFetcher(source, config)
+
+	var delays []time.Duration
+	f.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	return f, &delays
+}
+
+func TestResilientFetcherRetries(t *testing.T) {
+	config := ResilienceConfig{
+		MaxAttempts:   3,
+		BaseBackoff:   100 * time.Millisecond,
+		MaxBackoff:    150 * time.Millisecond,
+		MaxRetryAfter: 5 * time.Second,
+	}
+
+	cases := map[string]struct {
+		script           []flakyResponse
+		expectedRequests int
+		expectErr        bool
+		// the exact delays, if not drawn from the backoff
+		expectedDelays []time.Duration
+	}{
+		"no failure": {
+			expectedRequests: 1,
+		},
+		"server errors": {
+			script:           []flakyResponse{{status: 500}, {status: 502}},
+			expectedRequests: 3,
+		},
+		"network error": {
+			script:           []flakyResponse{{drop: true}},
+			expectedRequests: 2,
+		},
+		"too many server errors": {
+			script:           []flakyResponse{{status: 503}, {status: 503}, {status: 503}, {status: 503}},
+			expectedRequests: 3,
+			expectErr:        true,
+		},
+		"client error": {
+			script:           []flakyResponse{{status: 401}},
+			expectedRequests: 1,
+			expectErr:        true,
+			expectedDelays:   []time.Duration{},
+		},
+		"rate limited with Retry-After in seconds": {
+			script:           []flakyResponse{{status: 429, retryAfter: "2"}},
+			expectedRequests: 2,
+			expectedDelays:   []time.Duration{2 * time.Second},
+		},
+		"rate limited without Retry-After": {
+			script:           []flakyResponse{{status: 429}},
+			expectedRequests: 2,
+		},
+		"rate limited for too long": {
+			script:           []flakyResponse{{status: 429, retryAfter: "60"}},
+			expectedRequests: 1,
+			expectErr:        true,
+			expectedDelays:   []time.Duration{},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			endpoint := &flakyTokenEndpoint{script: tc.script}
+			f, delays := newFlakyFetcher(t, endpoint, config)
+
+			token, err := f.Fetch(context.Background(), []string{"acls"})
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "testToken", token.AccessToken)
+			}
+			assert.Equal(t, tc.expectedRequests, endpoint.count())
+
+			if tc.expectedDelays != nil {
+				assert.ElementsMatch(t, tc.expectedDelays, *delays)
+				return
+			}
+
+			// one delay before every retry, jittered between half and all of the capped exponential backoff
+			require.Len(t, *delays, tc.expectedRequests-1)
+			for i, delay := range *delays {
+				backoff := min(config.BaseBackoff<<i, config.MaxBackoff)
+				assert.LessOrEqual(t, delay, backoff)
+				assert.GreaterOrEqual(t, delay, backoff/2)
+			}
+		})
+	}
+}
+
+func TestResilientFetcherCircuitBreaker(t *testing.T) {
+	config := ResilienceConfig{
+		MaxAttempts:      2,
+		FailureThreshold: 2,
+		Cooldown:         time.Minute,
+	}
+	failure := flakyResponse{status: 500}
+	endpoint := &flakyTokenEndpoint{script: []flakyResponse{failure, failure, failure, failure, failure, failure}}
+	f, _ := newFlakyFetcher(t, endpoint, config)
+
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// two fetches failing after their retries open the circuit
+	for range 2 {
+		_, err := f.Fetch(ctx, []string{"acls"})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.Equal(t, 4, endpoint.count())
+
+	_, err := f.Fetch(ctx, []string{"acls"})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 4, endpoint.count(), "token endpoint called while the circuit is open")
+
+	// after the cooldown, a failing probe opens the circuit again right away
+	now = now.Add(config.Cooldown)
+	_, err = f.Fetch(ctx, []string{"acls"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 6, endpoint.count())
+
+	_, err = f.Fetch(ctx, []string{"acls"})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// a successful probe closes it
+	now = now.Add(config.Cooldown)
+	_, err = f.Fetch(ctx, []string{"acls"})
+	require.NoError(t, err)
+	_, err = f.Fetch(ctx, []string{"acls"})
+	require.NoError(t, err)
+	assert.Equal(t, 8, endpoint.count())
+}
+
+// A fetch whose request is canceled while waiting to retry does not count against the circuit
+func TestResilientFetcherCanceled(t *testing.T) {
+	config := ResilienceConfig{MaxAttempts: 3, BaseBackoff: time.Hour, MaxBackoff: time.Hour, FailureThreshold: 1}
+	endpoint := &flakyTokenEndpoint{script: []flakyResponse{{status: 500}}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	f := NewResilientFetcher(NewOAuthFetcher("testClientID", "testClientSecret", srv.URL).source, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := f.Fetch(ctx, []string{"acls"})
+	require.Error(t, err)
+
+	token, err := f.Fetch(context.Background(), []string{"acls"})
+	require.NoError(t, err)
+	assert.Equal(t, "testToken", token.AccessToken)
+}
+
+func TestTokenRequestHandlerUpstreamUnavailable(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	policies := policy.PolicyList{
+		{
+			Issuer:        "https://example.com",
+			AllowedScopes: []string{"scope1"},
+		},
+	}
+	endpoint := &flakyTokenEndpoint{script: []flakyResponse{{status: 500}, {status: 500}}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	fetcher := NewOAuthFetcher("testClientID", "testClientSecret", srv.URL, WithResilience(ResilienceConfig{
+		MaxAttempts:      1,
+		FailureThreshold: 1,
+		Cooldown:         time.Hour,
+	}))
+	handler := NewTokenRequestHandler(log, policies, fetcher, &StaticVerifier{})
+
+	expected := []ErrorCode{CodeUpstreamError, CodeUpstreamUnavailable, CodeUpstreamUnavailable}
+	for _, code := range expected {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"scopes":["scope1"]}`))
+		req.Header.Set("Authorization", "Bearer "+generateToken(t, defaultIssuer, defaultSubject))
+		req.Header.Set("Accept", "application/json")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, code.Status(), w.Code, w.Body.String())
+
+		var resp Error
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, code, resp.Code)
+	}
+	assert.Equal(t, 1, endpoint.count())
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		"empty":     {header: "", ok: false},
+		"seconds":   {header: "3", expected: 3 * time.Second, ok: true},
+		"date":      {header: now.Add(time.Minute).Format(http.TimeFormat), expected: time.Minute, ok: true},
+		"past date": {header: now.Add(-time.Minute).Format(http.TimeFormat), expected: 0, ok: true},
+		"nonsense":  {header: "soon", ok: false},
+		"negative":  {header: "-5", expected: 0, ok: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			delay, ok := retryAfter(tc.header, now)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, delay)
+		})
+	}
+}
@@ -9,15 +9,22 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/MicahParks/keyfunc/v3"
+	"github.com/jacobmichels/tail-sts/pkg/policy"
+	"golang.org/x/oauth2"
 )
 
 type AccessTokenFetcher interface {
-	Fetch(ctx context.Context, scopes []string) (string, error)
+	Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error)
+}
+
+// Provides the active policies. Implemented by policy.PolicyList and policy.Store.
+type PolicyProvider interface {
+	Policies() policy.PolicyList
 }
 
 type OIDCTokenVerifier interface {
-	Verify(token, alg string, kf keyfunc.Keyfunc) error
+	// Verifies the token against the keys and algorithms the policy trusts
+	Verify(token string, p *policy.Policy) error
 }
 
 func Start(ctx context.Context, logger *slog.Logger, handler http.Handler, port int) {
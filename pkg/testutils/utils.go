@@ -2,13 +2,20 @@ package testutils
 
 import (
 	"context"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
-// An AccessTokenFetcher that always returns the same token
+// An AccessTokenFetcher that always returns the same token, valid for an hour
 type StaticFetcher struct {
 	AccessToken string
 }
 
-func (s *StaticFetcher) Fetch(ctx context.Context, scopes []string) (string, error) {
-	return s.AccessToken, nil
+func (s *StaticFetcher) Fetch(ctx context.Context, scopes []string) (*oauth2.Token, error) {
+	return &oauth2.Token{
+		AccessToken: s.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
 }
@@ -94,12 +94,12 @@ func testPolicies(t *testing.T, issuerURL, localJWKSUrl, subject string) policy.
 	p := policy.Policy{
 
 		Issuer:        issuerURL,
-		Algorithm:     "RS256",
+		Algorithms:    policy.StringList{"RS256"},
 		Subject:       &subject,
 		JwksURL:       localJWKSUrl,
 		AllowedScopes: []string{"devices:read", "acls"},
 	}
-	err := p.LoadJwks(context.Background())
+	err := p.LoadJwks(context.Background(), testLogger(t))
 	require.NoError(t, err)
 
 	return policy.PolicyList{